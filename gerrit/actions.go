@@ -0,0 +1,185 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	actionSubmit     = "submit"
+	actionAbandon    = "abandon"
+	actionRebase     = "rebase"
+	actionMove       = "move"
+	actionCherryPick = "cherry_pick"
+)
+
+// changeActionsApi is the part of the REST API acting on changes; the ssh
+// api doesn't support it.
+type changeActionsApi interface {
+	GetMergeable(ctx context.Context, changeID, revision string) (gerrit.MergeableInfo, error)
+	GetRevisionActions(ctx context.Context, changeID, revision string) (map[string]*gerrit.ActionInfo, error)
+	SubmitChange(ctx context.Context, changeID string) (gerrit.ChangeInfo, error)
+	AbandonChange(ctx context.Context, changeID string, message ...string) error
+	RebaseChange(ctx context.Context, changeID string, ri gerrit.RebaseInput) (gerrit.ChangeInfo, error)
+	MoveChange(ctx context.Context, changeID string, mi gerrit.MoveInput) (gerrit.ChangeInfo, error)
+	CherryPickRevision(ctx context.Context, changeID, revisionID string, cpi gerrit.CherryPickInput) (gerrit.ChangeInfo, error)
+}
+
+func validateAction(src Source, params outParams) error {
+	if params.Action != "" && src.Api == "ssh" {
+		return fmt.Errorf("action %q not supported by api %q", params.Action, src.Api)
+	}
+	switch params.Action {
+	case "", actionSubmit, actionAbandon, actionRebase:
+	case actionMove:
+		if params.MoveBranch == "" {
+			return errors.New("action move requires param move_branch")
+		}
+	case actionCherryPick:
+		if len(params.CherryPickBranches) == 0 {
+			return errors.New("action cherry_pick requires param cherry_pick_branches")
+		}
+	default:
+		return fmt.Errorf("invalid action %q", params.Action)
+	}
+	return nil
+}
+
+// runAction runs params.Action on the change, setting the response version
+// to the resulting change.
+func runAction(
+	req resource.OutRequest,
+	src Source,
+	c gerritApi,
+	ctx context.Context,
+	params outParams,
+	ver Version,
+) error {
+	if params.Action == "" {
+		return nil
+	}
+	// validateAction rejects actions for apis that don't support them.
+	actions := c.(changeActionsApi)
+
+	var resultIds []string
+	switch params.Action {
+	case actionSubmit:
+		revisionActions, err := actions.GetRevisionActions(ctx, ver.ChangeId, ver.Revision)
+		if err != nil {
+			return fmt.Errorf("error getting revision actions: %v", err)
+		}
+		if submit := revisionActions["submit"]; submit == nil || !submit.Enabled {
+			return fmt.Errorf("revision %q of change %q is not submittable", ver.Revision, ver.ChangeId)
+		}
+		mergeable, err := actions.GetMergeable(ctx, ver.ChangeId, ver.Revision)
+		if err != nil {
+			return fmt.Errorf("error checking mergeability: %v", err)
+		}
+		if !mergeable.Mergeable {
+			return fmt.Errorf("change %q is not mergeable", ver.ChangeId)
+		}
+		change, err := actions.SubmitChange(ctx, ver.ChangeId)
+		if err != nil {
+			return fmt.Errorf("error submitting change: %v", err)
+		}
+		req.AddResponseMetadata("status", change.Status)
+
+	case actionAbandon:
+		var message []string
+		if params.AbandonMessage != "" {
+			message = append(message, params.AbandonMessage)
+		}
+		err := actions.AbandonChange(ctx, ver.ChangeId, message...)
+		if err != nil {
+			return fmt.Errorf("error abandoning change: %v", err)
+		}
+		req.AddResponseMetadata("status", "ABANDONED")
+
+	case actionRebase:
+		change, err := actions.RebaseChange(ctx, ver.ChangeId, gerrit.RebaseInput{
+			Base:           params.RebaseBase,
+			AllowConflicts: params.AllowConflicts,
+		})
+		if err != nil {
+			return fmt.Errorf("error rebasing change: %v", err)
+		}
+		resultIds = append(resultIds, change.ID)
+
+	case actionMove:
+		change, err := actions.MoveChange(ctx, ver.ChangeId, gerrit.MoveInput{
+			DestinationBranch: params.MoveBranch,
+		})
+		if err != nil {
+			return fmt.Errorf("error moving change: %v", err)
+		}
+		resultIds = append(resultIds, change.ID)
+
+	case actionCherryPick:
+		for _, branch := range params.CherryPickBranches {
+			change, err := actions.CherryPickRevision(ctx, ver.ChangeId, ver.Revision, gerrit.CherryPickInput{
+				Destination:    branch,
+				AllowConflicts: params.AllowConflicts,
+			})
+			if err != nil {
+				return fmt.Errorf("error cherry-picking to %q: %v", branch, err)
+			}
+			resultIds = append(resultIds, change.ID)
+		}
+	}
+
+	// The first resulting change becomes the new version.
+	for i, changeId := range resultIds {
+		change, err := c.GetChange(ctx, changeId, gerrit.QueryChangesOpt{Fields: []string{"CURRENT_REVISION"}})
+		if err != nil {
+			return fmt.Errorf("error getting change %q: %v", changeId, err)
+		}
+		rev, ok := change.Revisions[change.CurrentRevision]
+		if !ok {
+			return fmt.Errorf("no current revision on change %q", changeId)
+		}
+		if i == 0 {
+			req.SetResponseVersion(Version{
+				ChangeId: change.ID,
+				Revision: change.CurrentRevision,
+				Created:  rev.Created.Time(),
+			})
+		}
+
+		name := "result"
+		switch params.Action {
+		case actionRebase:
+			name = "rebased revision"
+		case actionMove:
+			name = "moved to " + params.MoveBranch
+		case actionCherryPick:
+			name = "cherry-picked to " + params.CherryPickBranches[i]
+		}
+		link, err := buildRevisionLink(src, change.ChangeNumber, rev.PatchSetNumber)
+		if err != nil {
+			log.Printf("error building revision link: %v", err)
+			link = change.ID
+		}
+		req.AddResponseMetadata(name, link)
+	}
+	return nil
+}
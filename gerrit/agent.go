@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgent serves an in-memory keyring over a unix socket in a private
+// temporary directory, for use by ssh as its IdentityAgent.
+type sshAgent struct {
+	dir      string
+	socket   string
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func startSshAgent(privateKeys []string, passphrase string) (*sshAgent, error) {
+	keyring := agent.NewKeyring()
+	for i, privateKey := range privateKeys {
+		key, err := ssh.ParseRawPrivateKey([]byte(privateKey))
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			if passphrase == "" {
+				return nil, errors.New(
+					"Private key has a passphrase but private_key_passphrase has not been set.")
+			}
+			key, err = ssh.ParseRawPrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing private key %d: %v", i+1, err)
+		}
+		err = keyring.Add(agent.AddedKey{PrivateKey: key})
+		if err != nil {
+			return nil, fmt.Errorf("Error adding private key %d to agent: %v", i+1, err)
+		}
+	}
+
+	// TempDir creates the directory readable only by us.
+	dir, err := ioutil.TempDir(authTempDir, "concourse-gerrit-agent")
+	if err != nil {
+		return nil, err
+	}
+	a := &sshAgent{
+		dir:    dir,
+		socket: filepath.Join(dir, "agent.sock"),
+		conns:  make(map[net.Conn]bool),
+	}
+	a.listener, err = net.Listen("unix", a.socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Error listening on ssh agent socket: %v", err)
+	}
+
+	a.wg.Add(1)
+	go a.serve(keyring)
+	return a, nil
+}
+
+func (a *sshAgent) serve(keyring agent.Agent) {
+	defer a.wg.Done()
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			// The listener was closed.
+			return
+		}
+		a.mu.Lock()
+		a.conns[conn] = true
+		a.mu.Unlock()
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			agent.ServeAgent(keyring, conn)
+			a.mu.Lock()
+			delete(a.conns, conn)
+			a.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// close stops the agent, waiting for open connections to be closed, and
+// removes its socket.
+func (a *sshAgent) close() {
+	a.listener.Close()
+	a.mu.Lock()
+	for conn := range a.conns {
+		conn.Close()
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+
+	err := os.RemoveAll(a.dir)
+	if err != nil {
+		log.Printf("error removing ssh agent dir %q: %s", a.dir, err)
+	}
+}
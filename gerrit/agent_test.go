@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func testPrivateKey(t *testing.T, passphrase string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestSshAgent(t *testing.T) {
+	a, err := startSshAgent([]string{
+		testPrivateKey(t, ""),
+		testPrivateKey(t, "secret"),
+	}, "secret")
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("unix", a.socket)
+	assert.NoError(t, err)
+	keys, err := agent.NewClient(conn).List()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	// Closing the agent closes open connections and removes the socket.
+	a.close()
+	_, err = agent.NewClient(conn).List()
+	assert.Error(t, err)
+	_, err = os.Stat(a.socket)
+	assert.True(t, os.IsNotExist(err), "%s wasn't deleted", a.socket)
+}
+
+func TestSshAgentMissingPassphrase(t *testing.T) {
+	_, err := startSshAgent([]string{testPrivateKey(t, "secret")}, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "private_key_passphrase")
+}
+
+func TestSshAgentBadPassphrase(t *testing.T) {
+	_, err := startSshAgent([]string{testPrivateKey(t, "secret")}, "wrong")
+	assert.Error(t, err)
+}
@@ -15,20 +15,30 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/build/gerrit"
+	"golang.org/x/oauth2"
 )
 
 var (
 	authTempDir = ""
+
+	// For testing
+	execSshKeyscan = realExecSshKeyscan
 )
 
 type authManager struct {
@@ -38,85 +48,68 @@ type authManager struct {
 	username                string
 	password                string
 	digest                  bool
+	digestChallenge         *digestChallenge
 	sshPrivateKeyPassphrase string
-	sshPrivateKey           string
+	sshPrivateKeys          []string
 	credsPath_              string
-	sshAgentVars            []string
+	sshAgent                *sshAgent
+
+	knownHosts          string
+	hostKeyFingerprints []string
+	knownHostsPath_     string
+	verifiedHosts       map[string]bool
+
+	authType             string
+	oauth2Token          string
+	oauth2ServiceAccount string
+	oauth2Scopes         []string
+	oauth2TokenSource_   oauth2.TokenSource
+	tokenServer          *tokenServer
+
+	caCert             string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+	caCertPath_        string
+	clientCertPath_    string
+	clientKeyPath_     string
 }
 
 func newAuthManager(source Source) *authManager {
-	return &authManager{
+	am := &authManager{
 		cookies:                 source.Cookies,
 		username:                source.Username,
 		password:                source.Password,
 		digest:                  source.DigestAuth,
-		sshPrivateKey:           source.PrivateKey,
 		sshPrivateKeyPassphrase: source.PrivateKeyPassphrase,
+		knownHosts:              source.KnownHosts,
+		hostKeyFingerprints:     source.HostKeyFingerprints,
+		authType:                source.Auth,
+		oauth2Token:             source.OAuth2Token,
+		oauth2ServiceAccount:    source.OAuth2ServiceAccount,
+		oauth2Scopes:            source.OAuth2Scopes,
+		caCert:                  source.CaCert,
+		clientCert:              source.ClientCert,
+		clientKey:               source.ClientKey,
+		insecureSkipVerify:      source.InsecureSkipVerify,
 	}
-}
-
-func (am *authManager) sshKillAgent() {
-	if len(am.sshAgentVars) > 0 {
-		cmd := exec.Command("ssh-agent", "-k")
-		cmd.Env = append(os.Environ(), am.sshAgentVars...)
-		cmd.Run()
-		am.sshAgentVars = []string{}
+	for _, key := range append([]string{source.PrivateKey}, source.PrivateKeys...) {
+		if key != "" {
+			am.sshPrivateKeys = append(am.sshPrivateKeys, key)
+		}
 	}
+	return am
 }
 
-func (am *authManager) sshAddKey() (err error) {
-	err = nil
-	// similar to https://github.com/concourse/git-resource/blob/master/assets/common.sh#L17
-	if am.sshPrivateKey != "" {
-		credsPath, err := storePrivateKey(am.sshPrivateKey)
+func (am *authManager) sshAgentSocket() (string, error) {
+	if am.sshAgent == nil {
+		var err error
+		am.sshAgent, err = startSshAgent(am.sshPrivateKeys, am.sshPrivateKeyPassphrase)
 		if err != nil {
-			return err
+			return "", err
 		}
-		// ensure that this will be cleaned up at the end
-		am.credsPath_ = credsPath
-		output, err := exec.Command("ssh-agent", "-s").CombinedOutput()
-		if err != nil {
-			return err
-		}
-
-		// -s ensures bash style variable assignments
-		//keep variable assignments, remove everything else...
-		//SSH_AUTH_SOCK=/tmp/ssh-ozasB2N7ff0j/agent.111798; export SSH_AUTH_SOCK;
-		//SSH_AGENT_PID=111799; export SSH_AGENT_PID;
-		//echo Agent pid 111799;`
-		vars := []string{}
-		lines := strings.Split(string(output), "\n")
-		for _, s := range lines {
-			assignment := strings.Split(s, ";")
-			if len(assignment) > 0 && strings.Contains(assignment[0], "=") {
-				vars = append(vars, assignment[0])
-				envVar := strings.Split(assignment[0], "=")
-				if len(envVar) >= 2 {
-					os.Setenv(envVar[0], envVar[1])
-				}
-			}
-		}
-		am.sshAgentVars = vars
-		if err != nil {
-			return err
-		}
-		cmd := exec.Command("ssh-add", credsPath)
-		executablePath, err := os.Executable()
-		if err != nil {
-			return err
-		}
-		vars = append(vars,
-			fmt.Sprintf("GIT_SSH_PRIVATE_KEY_PASS=%s", am.sshPrivateKeyPassphrase),
-			"SSH_ASKPASS_REQUIRE=force",
-			fmt.Sprintf("SSH_ASKPASS=%s", path.Join(path.Dir(executablePath), "askpass.sh")),
-			"DISPLAY=",
-		)
-		cmd.Env = append(os.Environ(),
-			vars...,
-		)
-		_, err = cmd.CombinedOutput()
 	}
-	return err
+	return am.sshAgent.socket, nil
 }
 
 func (am *authManager) cookiesPath() (string, error) {
@@ -137,7 +130,7 @@ func (am *authManager) credsPath() (string, error) {
 	}
 
 	var err error
-	if am.credsPath_ == "" && am.sshPrivateKey == "" {
+	if am.credsPath_ == "" {
 		// See: https://www.kernel.org/pub/software/scm/git/docs/git-credential.html#IOFMT
 		if strings.ContainsAny(am.username, "\x00\n") ||
 			strings.ContainsAny(am.password, "\x00\n") {
@@ -150,7 +143,113 @@ func (am *authManager) credsPath() (string, error) {
 	return am.credsPath_, err
 }
 
+// strictHostKeys reports whether ssh host keys are checked against the
+// known hosts.
+func (am *authManager) strictHostKeys() bool {
+	return am.knownHosts != "" || len(am.hostKeyFingerprints) > 0
+}
+
+func (am *authManager) knownHostsPath() (string, error) {
+	if !am.strictHostKeys() {
+		return "", nil
+	}
+	var err error
+	if am.knownHostsPath_ == "" {
+		am.knownHostsPath_, err = writeAuthTempFile(
+			"concourse-gerrit-known-hosts", am.knownHosts)
+	}
+	return am.knownHostsPath_, err
+}
+
+// verifyHostKeys scans the host keys offered by the ssh server of fetchUrl
+// and adds those matching the pinned fingerprints to the known hosts.
+func (am *authManager) verifyHostKeys(fetchUrl string) error {
+	if len(am.hostKeyFingerprints) == 0 {
+		return nil
+	}
+	host, port, ok := sshUrlHostPort(fetchUrl)
+	if !ok {
+		// Not fetched over ssh.
+		return nil
+	}
+	hostPort := net.JoinHostPort(host, port)
+	if am.verifiedHosts[hostPort] {
+		return nil
+	}
+
+	output, err := execSshKeyscan("-p", port, host)
+	if err != nil {
+		return fmt.Errorf("error scanning host keys of %s: %v", host, err)
+	}
+	var offered []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fingerprint, err := sshFingerprint(fields[2])
+		if err != nil {
+			return fmt.Errorf("error reading host key of %s: %v", host, err)
+		}
+		for _, pinned := range am.hostKeyFingerprints {
+			if strings.TrimRight(pinned, "=") == fingerprint {
+				if am.verifiedHosts == nil {
+					am.verifiedHosts = make(map[string]bool)
+				}
+				am.verifiedHosts[hostPort] = true
+				return am.addKnownHost(line)
+			}
+		}
+		offered = append(offered, fmt.Sprintf("%s %s", fields[1], fingerprint))
+	}
+	return fmt.Errorf(
+		"host key verification failed for %s: offered [%s], expected one of [%s]",
+		host, strings.Join(offered, ", "), strings.Join(am.hostKeyFingerprints, ", "))
+}
+
+// addKnownHost adds a known hosts line, including to the known hosts file
+// if it's already written.
+func (am *authManager) addKnownHost(line string) error {
+	am.knownHosts += "\n" + line + "\n"
+	if am.knownHostsPath_ == "" {
+		return nil
+	}
+	f, err := os.OpenFile(am.knownHostsPath_, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("\n" + line + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (am *authManager) oauth2TokenSource() (oauth2.TokenSource, error) {
+	if am.oauth2TokenSource_ == nil {
+		tokenSource, err := newOAuth2TokenSource(
+			am.oauth2Token, am.oauth2ServiceAccount, am.oauth2Scopes)
+		if err != nil {
+			return nil, err
+		}
+		am.oauth2TokenSource_ = oauth2.ReuseTokenSource(nil, tokenSource)
+	}
+	return am.oauth2TokenSource_, nil
+}
+
 func (am *authManager) gerritAuth() (gerrit.Auth, error) {
+	switch am.authType {
+	case "":
+	case "oauth2":
+		tokenSource, err := am.oauth2TokenSource()
+		if err != nil {
+			return nil, err
+		}
+		return gerrit.OAuth2Auth(tokenSource), nil
+	default:
+		return nil, fmt.Errorf("unknown auth %q", am.authType)
+	}
+
 	if am.username != "" {
 		if am.digest {
 			return gerrit.DigestAuth(am.username, am.password), nil
@@ -170,14 +269,150 @@ func (am *authManager) gerritAuth() (gerrit.Auth, error) {
 	}
 }
 
+// setRequestAuth adds the credentials gerritAuth gives the gerrit client to
+// req, for requests sent outside of the gerrit client. With digest auth, req
+// is left unauthenticated until the server's challenge is known; see
+// setDigestChallenge.
+func (am *authManager) setRequestAuth(req *http.Request) error {
+	switch am.authType {
+	case "":
+	case "oauth2":
+		tokenSource, err := am.oauth2TokenSource()
+		if err != nil {
+			return err
+		}
+		token, err := tokenSource.Token()
+		if err != nil {
+			return err
+		}
+		token.SetAuthHeader(req)
+		return nil
+	default:
+		return fmt.Errorf("unknown auth %q", am.authType)
+	}
+
+	if am.username != "" {
+		if !am.digest {
+			req.SetBasicAuth(am.username, am.password)
+		} else if am.digestChallenge != nil {
+			authorization, err := am.digestChallenge.authorization(
+				am.username, am.password, req.Method, req.URL.RequestURI())
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", authorization)
+		}
+	} else if am.password != "" {
+		return errors.New("Password specified but username is blank")
+	} else {
+		for _, cookie := range gitCookies(am.cookies, req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
+	return nil
+}
+
+// setDigestChallenge keeps the digest challenge in a 401 response's
+// WWW-Authenticate header for later requests, reporting whether the request
+// should be retried with it.
+func (am *authManager) setDigestChallenge(header string) (bool, error) {
+	if am.username == "" || !am.digest {
+		return false, nil
+	}
+	challenge, err := parseDigestChallenge(header)
+	if err != nil || challenge == nil {
+		return false, err
+	}
+	am.digestChallenge = challenge
+	return true, nil
+}
+
+// gitCookies returns the cookies for u in cookies, a git http.cookieFile in
+// the Netscape cookie file format.
+func gitCookies(cookies string, u *url.URL) []*http.Cookie {
+	var matched []*http.Cookie
+	host := u.Hostname()
+	for _, line := range strings.Split(cookies, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// domain, include subdomains, path, secure, expires, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain := strings.TrimPrefix(fields[0], ".")
+		if host != domain && !(fields[1] == "TRUE" && strings.HasSuffix(host, "."+domain)) {
+			continue
+		}
+		if !strings.HasPrefix(u.Path, fields[2]) || (fields[3] == "TRUE" && u.Scheme != "https") {
+			continue
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil || (expires != 0 && time.Unix(expires, 0).Before(time.Now())) {
+			continue
+		}
+		matched = append(matched, &http.Cookie{Name: fields[5], Value: fields[6]})
+	}
+	return matched
+}
+
+// sshArgs returns the ssh options used by git and the ssh api.
+func (am *authManager) sshArgs() ([]string, error) {
+	// -F /dev/null is paranoia to prevent any other ssh config from being used
+	args := []string{"-F", "/dev/null"}
+	if am.strictHostKeys() {
+		knownHostsPath, err := am.knownHostsPath()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args,
+			"-o", "UserKnownHostsFile="+knownHostsPath,
+			"-o", "StrictHostKeyChecking=yes")
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=no")
+	}
+	if len(am.sshPrivateKeys) > 0 {
+		agentSocket, err := am.sshAgentSocket()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-o", "IdentityAgent="+agentSocket)
+	}
+	return args, nil
+}
+
 func (am *authManager) gitConfigArgs() (map[string]string, error) {
 	args := make(map[string]string)
-	if am.sshPrivateKey != "" {
-		// -F /dev/null is paranoia to prevent any other ssh config from being used
-		// TODO: replace -o StrictHostKeyChecking=no with an explicit host fingerprint!
-		am.sshAddKey()
-		args["core.sshCommand"] = "ssh -F /dev/null -o StrictHostKeyChecking=no"
-	} else if am.username != "" {
+	if am.strictHostKeys() || len(am.sshPrivateKeys) > 0 {
+		sshArgs, err := am.sshArgs()
+		if err != nil {
+			return nil, err
+		}
+		args["core.sshCommand"] = "ssh " + shellJoin(sshArgs)
+	}
+
+	switch {
+	case len(am.sshPrivateKeys) > 0:
+		// Authenticate with the ssh agent only.
+	case am.authType == "oauth2":
+		if am.tokenServer == nil {
+			tokenSource, err := am.oauth2TokenSource()
+			if err != nil {
+				return nil, err
+			}
+			am.tokenServer, err = startTokenServer(tokenSource)
+			if err != nil {
+				return nil, err
+			}
+		}
+		helper, err := am.tokenServer.credentialHelperCommand()
+		if err != nil {
+			return nil, err
+		}
+		args["credential.helper"] = helper
+	case am.username != "":
 		// See: https://www.kernel.org/pub/software/scm/git/docs/technical/api-credentials.html#_credential_helpers
 		credsPath, err := am.credsPath()
 		if err != nil {
@@ -194,11 +429,19 @@ func (am *authManager) gitConfigArgs() (map[string]string, error) {
 		args["http.cookieFile"] = cookiesPath
 	}
 
+	err := am.tlsGitConfigArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
 	return args, nil
 }
 
 func (am *authManager) cleanup() {
-	for _, path := range []*string{&am.cookiesPath_, &am.credsPath_} {
+	for _, path := range []*string{
+		&am.cookiesPath_, &am.credsPath_, &am.knownHostsPath_,
+		&am.caCertPath_, &am.clientCertPath_, &am.clientKeyPath_,
+	} {
 		if *path != "" {
 			err := os.Remove(*path)
 			if err != nil {
@@ -207,14 +450,57 @@ func (am *authManager) cleanup() {
 			*path = ""
 		}
 	}
-	if am.cookiesPath_ != "" {
-		err := os.Remove(am.cookiesPath_)
+	if am.sshAgent != nil {
+		am.sshAgent.close()
+		am.sshAgent = nil
+	}
+	if am.tokenServer != nil {
+		am.tokenServer.close()
+		am.tokenServer = nil
+	}
+}
+
+// sshUrlHostPort returns the host and port of an ssh:// or scp-like git URL.
+func sshUrlHostPort(rawUrl string) (host, port string, ok bool) {
+	if strings.HasPrefix(rawUrl, "ssh://") {
+		u, err := url.Parse(rawUrl)
 		if err != nil {
-			log.Printf("error removing cookies file: %s", err)
+			return "", "", false
+		}
+		port = u.Port()
+		if port == "" {
+			port = "22"
 		}
-		am.cookiesPath_ = ""
+		return u.Hostname(), port, true
+	}
+	// scp-like syntax: [user@]host:path
+	if strings.Contains(rawUrl, "://") {
+		return "", "", false
+	}
+	colon := strings.Index(rawUrl, ":")
+	if colon < 0 {
+		return "", "", false
 	}
-	am.sshKillAgent()
+	host = rawUrl[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	return host, "22", true
+}
+
+// sshFingerprint returns the OpenSSH SHA256 fingerprint of a base64 encoded
+// public key, as printed by ssh-keygen -l.
+func sshFingerprint(key string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
+
+func realExecSshKeyscan(args ...string) ([]byte, error) {
+	return exec.Command("ssh-keyscan", args...).Output()
 }
 
 func writeAuthTempFile(suffix string, contents string) (string, error) {
@@ -231,30 +517,3 @@ func writeAuthTempFile(suffix string, contents string) (string, error) {
 
 	return f.Name(), nil
 }
-
-func storePrivateKey(privateKey string) (privateKeyPath string, err error) {
-	// https://github.com/concourse/git-resource/blob/master/assets/common.sh#L4
-	if privateKey == "" {
-		return
-	}
-	privateKeyFile, err := ioutil.TempFile("", "gerrit-resource-private-key-*")
-	if err != nil {
-		err = fmt.Errorf("Error storing private key: %v", err)
-		return
-	}
-	err = os.Chmod(privateKeyFile.Name(), 0600)
-	if err != nil {
-		err = fmt.Errorf("Error changing file access mode for private key: %v", err)
-	}
-	_, err = privateKeyFile.Write([]byte(privateKey))
-	privateKeyPath = privateKeyFile.Name()
-	if err != nil {
-		err2 := privateKeyFile.Truncate(0)
-		err2str := ""
-		if err2 != nil {
-			err2str = fmt.Sprintf(" %v", err2)
-		}
-		err = fmt.Errorf("Error writing to private key file: %v%v", err, err2str)
-	}
-	return
-}
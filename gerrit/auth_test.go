@@ -0,0 +1,50 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitCookies(t *testing.T) {
+	cookies := "# Netscape HTTP Cookie File\n" +
+		"review.example.com\tFALSE\t/\tTRUE\t9999999999\texact\t1\n" +
+		".example.com\tTRUE\t/\tTRUE\t0\tsubdomain\t2\n" +
+		"#HttpOnly_review.example.com\tFALSE\t/a/\tTRUE\t9999999999\thttponly\t3\n" +
+		"review.example.com\tFALSE\t/\tTRUE\t1\texpired\t4\n" +
+		"other.example.com\tFALSE\t/\tTRUE\t9999999999\tother\t5\n" +
+		"review.example.com\tFALSE\t/\tTRUE\t9999999999\tbroken\n"
+
+	for _, test := range []struct {
+		url   string
+		names []string
+	}{
+		{"https://review.example.com/a/changes/", []string{"exact", "subdomain", "httponly"}},
+		{"https://review.example.com/changes/", []string{"exact", "subdomain"}},
+		{"http://review.example.com/a/changes/", nil},
+		{"https://example.org/a/", nil},
+	} {
+		u, err := url.Parse(test.url)
+		assert.NoError(t, err)
+		var names []string
+		for _, cookie := range gitCookies(cookies, u) {
+			names = append(names, cookie.Name)
+		}
+		assert.Equal(t, test.names, names, test.url)
+	}
+}
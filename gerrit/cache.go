@@ -0,0 +1,217 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	gitCacheMirrorSuffix = ".git"
+	gitCacheLockSuffix   = ".lock"
+)
+
+// gitCache is a bare mirror of a fetch URL in the source cache_dir, locked
+// for exclusive use while open.
+type gitCache struct {
+	dir    string
+	mirror string
+	lock   *os.File
+}
+
+// useGitCache updates the cache mirror for fetchUrl and references it from
+// the repo in dir. The returned cache must be closed once the repo has been
+// fetched.
+func useGitCache(
+	dir string,
+	src Source,
+	configArgs map[string]string,
+	fetchUrl, fetchRef string,
+) (*gitCache, error) {
+	cache, err := openGitCache(src.CacheDir, fetchUrl)
+	if err != nil {
+		return nil, err
+	}
+	err = cache.update(configArgs, fetchUrl, fetchRef)
+	if err == nil {
+		err = cache.reference(dir)
+	}
+	if err != nil {
+		cache.close()
+		return nil, err
+	}
+	if src.CacheMaxSize > 0 {
+		err = pruneGitCache(src.CacheDir, src.CacheMaxSize*1024*1024)
+		if err != nil {
+			log.Printf("error pruning git cache: %v", err)
+		}
+	}
+	return cache, nil
+}
+
+func openGitCache(cacheDir string, fetchUrl string) (*gitCache, error) {
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache dir: %v", err)
+	}
+
+	hash := sha1.Sum([]byte(fetchUrl))
+	name := hex.EncodeToString(hash[:])
+	lock, err := os.OpenFile(
+		filepath.Join(cacheDir, name+gitCacheLockSuffix), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cache lock: %v", err)
+	}
+	log.Printf("Waiting for cache lock %v", lock.Name())
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("error locking cache: %v", err)
+	}
+
+	gc := &gitCache{
+		dir:    cacheDir,
+		mirror: filepath.Join(cacheDir, name+gitCacheMirrorSuffix),
+		lock:   lock,
+	}
+	// The mirror's mtime records when it was last used, for pruning.
+	now := time.Now()
+	err = os.MkdirAll(gc.mirror, 0755)
+	if err == nil {
+		err = os.Chtimes(gc.mirror, now, now)
+	}
+	if err != nil {
+		gc.close()
+		return nil, fmt.Errorf("error creating cache mirror: %v", err)
+	}
+	return gc, nil
+}
+
+// update fetches all branches and the given ref from fetchUrl into the mirror.
+// The ref is only fetched into FETCH_HEAD, so the mirror doesn't keep a ref
+// (and its objects) for every change fetched through it.
+func (gc *gitCache) update(configArgs map[string]string, fetchUrl, fetchRef string) error {
+	_, err := os.Stat(filepath.Join(gc.mirror, "HEAD"))
+	if os.IsNotExist(err) {
+		err = git(gc.mirror, "init", "--bare")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Credentials are passed on the command line so that temporary auth
+	// files don't outlive this step in the mirror config.
+	args := append(gitConfigFlags(configArgs), "fetch", "--prune", fetchUrl,
+		"+refs/heads/*:refs/heads/*", fetchRef)
+	return git(gc.mirror, args...)
+}
+
+// reference makes the objects in the mirror available to the repo in dir.
+func (gc *gitCache) reference(dir string) error {
+	alternatesPath := filepath.Join(dir, ".git", "objects", "info", "alternates")
+	err := os.MkdirAll(filepath.Dir(alternatesPath), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(alternatesPath, []byte(filepath.Join(gc.mirror, "objects")+"\n"), 0644)
+}
+
+// dissociate copies the referenced objects into the repo in dir so it no
+// longer depends on the mirror.
+func (gc *gitCache) dissociate(dir string) error {
+	err := git(dir, "repack", "-a", "-d")
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, ".git", "objects", "info", "alternates"))
+}
+
+func (gc *gitCache) close() {
+	if gc.lock != nil {
+		gc.lock.Close()
+		gc.lock = nil
+	}
+}
+
+// pruneGitCache removes the least recently used mirrors from cacheDir until
+// it is no bigger than maxBytes. Mirrors that are in use are skipped.
+func pruneGitCache(cacheDir string, maxBytes int64) error {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	type mirror struct {
+		path string
+		used time.Time
+		size int64
+	}
+	var mirrors []mirror
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), gitCacheMirrorSuffix) {
+			continue
+		}
+		m := mirror{path: filepath.Join(cacheDir, entry.Name()), used: entry.ModTime()}
+		err = filepath.Walk(m.path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				m.size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		total += m.size
+		mirrors = append(mirrors, m)
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].used.Before(mirrors[j].used)
+	})
+	for _, m := range mirrors {
+		if total <= maxBytes {
+			break
+		}
+		lockPath := strings.TrimSuffix(m.path, gitCacheMirrorSuffix) + gitCacheLockSuffix
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		if syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+			log.Printf("Not pruning cache mirror %v: in use", m.path)
+			lock.Close()
+			continue
+		}
+		log.Printf("Pruning cache mirror %v (%d bytes)", m.path, m.size)
+		err = os.RemoveAll(m.path)
+		lock.Close()
+		if err != nil {
+			return err
+		}
+		total -= m.size
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCacheMirror(t *testing.T, cacheDir string) string {
+	mirrors, err := filepath.Glob(filepath.Join(cacheDir, "*"+gitCacheMirrorSuffix))
+	assert.NoError(t, err)
+	assert.Len(t, mirrors, 1)
+	return mirrors[0]
+}
+
+func TestInGitCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir(testTempDir, "cache")
+	assert.NoError(t, err)
+	testGitCalls = nil
+
+	testIn(t, Source{CacheDir: cacheDir}, testInVersion, InParams{})
+
+	mirror := testCacheMirror(t, cacheDir)
+	fetchUrl := fmt.Sprintf("%s/testproject.git", testGerritUrl)
+	assert.Equal(t, []string{
+		"init --bare",
+		fmt.Sprintf("fetch --prune %s +refs/heads/*:refs/heads/* refs/changes/1/1/1", fetchUrl),
+	}, testGitCallsIn(mirror))
+	assert.Contains(t, testGitCallsIn(testInDestDir), "repack -a -d")
+
+	_, err = os.Stat(filepath.Join(testInDestDir, ".git", "objects", "info", "alternates"))
+	assert.True(t, os.IsNotExist(err), "alternates wasn't removed")
+}
+
+func TestInGitCacheShared(t *testing.T) {
+	cacheDir, err := ioutil.TempDir(testTempDir, "cache")
+	assert.NoError(t, err)
+	testGitCalls = nil
+
+	testIn(t, Source{CacheDir: cacheDir, CacheShared: true}, testInVersion, InParams{})
+
+	mirror := testCacheMirror(t, cacheDir)
+	assert.NotContains(t, testGitCallsIn(testInDestDir), "repack -a -d")
+	alternates, err := ioutil.ReadFile(
+		filepath.Join(testInDestDir, ".git", "objects", "info", "alternates"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(mirror, "objects")+"\n", string(alternates))
+}
+
+func TestInGitCacheFilter(t *testing.T) {
+	cacheDir, err := ioutil.TempDir(testTempDir, "cache")
+	assert.NoError(t, err)
+	testGitCalls = nil
+
+	testIn(t, Source{CacheDir: cacheDir, Filter: "blob:none"}, testInVersion, InParams{})
+
+	mirrors, err := filepath.Glob(filepath.Join(cacheDir, "*"+gitCacheMirrorSuffix))
+	assert.NoError(t, err)
+	assert.Empty(t, mirrors)
+	assert.NotContains(t, testGitCallsIn(testInDestDir), "repack -a -d")
+
+	testGitCalls = nil
+	testIn(t, Source{CacheDir: cacheDir, Filter: "blob:none", CacheShared: true},
+		testInVersion, InParams{})
+	testCacheMirror(t, cacheDir)
+	assert.NotContains(t, testGitCallsIn(testInDestDir), "repack -a -d")
+}
+
+func TestPruneGitCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir(testTempDir, "cache")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	for i, name := range []string{"locked", "old", "new"} {
+		mirror := filepath.Join(cacheDir, name+gitCacheMirrorSuffix)
+		assert.NoError(t, os.MkdirAll(filepath.Join(mirror, "objects"), 0755))
+		assert.NoError(t, ioutil.WriteFile(
+			filepath.Join(mirror, "objects", "pack"), make([]byte, 100), 0644))
+		used := now.Add(time.Duration(i-3) * time.Hour)
+		assert.NoError(t, os.Chtimes(mirror, used, used))
+	}
+
+	// Mirrors in use by another step are never pruned.
+	lock, err := os.OpenFile(
+		filepath.Join(cacheDir, "locked"+gitCacheLockSuffix), os.O_CREATE|os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer lock.Close()
+	assert.NoError(t, syscall.Flock(int(lock.Fd()), syscall.LOCK_EX))
+
+	assert.NoError(t, pruneGitCache(cacheDir, 250))
+
+	for name, exists := range map[string]bool{"old": false, "locked": true, "new": true} {
+		_, err := os.Stat(filepath.Join(cacheDir, name+gitCacheMirrorSuffix))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
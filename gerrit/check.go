@@ -53,10 +53,17 @@ func check(req resource.CheckRequest) error {
 		return err
 	}
 
+	if src.Api == "ssh" {
+		err = src.WriteSshConfig()
+		if err != nil {
+			return err
+		}
+	}
+
 	authMan := newAuthManager(src)
 	defer authMan.cleanup()
 
-	c, err := gerritClient(src, authMan)
+	c, err := gerritApiClient(src, authMan)
 	if err != nil {
 		return fmt.Errorf("error setting up gerrit client: %v", err)
 	}
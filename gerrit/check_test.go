@@ -72,7 +72,7 @@ func TestCheckWithoutVersion(t *testing.T) {
 }
 
 func TestCheckWithNewVersions(t *testing.T) {
-	versions := testCheck(t, Source{}, Version{
+	versions := testCheck(t, Source{PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "deadbeef0",
 		Created:  time.Unix(1, 0),
@@ -94,7 +94,7 @@ func TestCheckWithoutNewVersions(t *testing.T) {
 }
 
 func TestCheckVersionsSorted(t *testing.T) {
-	versions := testCheck(t, Source{}, Version{
+	versions := testCheck(t, Source{PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "deadbeef0",
 		Created:  time.Unix(2, 0),
@@ -106,7 +106,7 @@ func TestCheckVersionsSorted(t *testing.T) {
 }
 
 func TestCheckWithBadRevision(t *testing.T) {
-	versions := testCheck(t, Source{}, Version{
+	versions := testCheck(t, Source{PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "badrevision",
 	})
@@ -116,21 +116,21 @@ func TestCheckWithBadRevision(t *testing.T) {
 }
 
 func TestCheckTimestampCaching(t *testing.T) {
-	testCheck(t, Source{Query: "foo"}, Version{
+	testCheck(t, Source{Query: "foo", PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "deadbeaf0",
 		Created:  time.Unix(100, 0),
 	})
 	assert.Equal(t, "(foo) AND after:{1970-01-01 00:01:40}", testGerritLastQ)
 
-	testCheck(t, Source{Query: "foo"}, Version{
+	testCheck(t, Source{Query: "foo", PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "deadbeaf0",
 		Created:  time.Unix(100, 0),
 	})
 	assert.Equal(t, "(foo) AND after:{1970-01-01 05:35:00}", testGerritLastQ)
 
-	testCheck(t, Source{Query: "bar"}, Version{
+	testCheck(t, Source{Query: "bar", PatchsetVersions: "every"}, Version{
 		ChangeId: "Itestchange1",
 		Revision: "deadbeaf0",
 		Created:  time.Unix(100, 0),
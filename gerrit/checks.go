@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+// validCheckStates are the states of a check run in the checks plugin, and
+// whether they are final.
+var validCheckStates = map[string]bool{
+	"NOT_STARTED":  false,
+	"SCHEDULED":    false,
+	"RUNNING":      false,
+	"SUCCESSFUL":   true,
+	"FAILED":       true,
+	"NOT_RELEVANT": true,
+}
+
+// checkInput is the body of a checks plugin create check request, which
+// creates or updates the checker's check on a revision.
+type checkInput struct {
+	CheckerUuid string `json:"checker_uuid"`
+	State       string `json:"state"`
+	Message     string `json:"message,omitempty"`
+	Url         string `json:"url,omitempty"`
+	Started     string `json:"started,omitempty"`
+	Finished    string `json:"finished,omitempty"`
+}
+
+// validateCheck rejects check params the api doesn't support, and review
+// params that a check can't carry.
+func validateCheck(src Source, params outParams) error {
+	if params.CheckerUuid == "" {
+		return nil
+	}
+	if src.Api == "ssh" {
+		return errors.New("checker_uuid is not supported by api \"ssh\"")
+	}
+	if _, ok := validCheckStates[params.CheckState]; !ok {
+		return fmt.Errorf("invalid check_state %q", params.CheckState)
+	}
+	reviewParams := []struct {
+		name string
+		set  bool
+	}{
+		{"labels", len(params.Labels) > 0},
+		{"labels_file", params.LabelsFile != ""},
+		{"junit_label", params.JunitLabel != ""},
+		{"comments_file", params.CommentsFile != ""},
+		{"reviewers", len(params.Reviewers) > 0},
+		{"ccs", len(params.Ccs) > 0},
+		{"reviewers_file", params.ReviewersFile != ""},
+		{"idempotent", params.Idempotent},
+	}
+	for _, p := range reviewParams {
+		if p.set {
+			return fmt.Errorf("%s can't be used with checker_uuid", p.name)
+		}
+	}
+	return nil
+}
+
+// checksApi is the checks plugin REST API; the ssh api doesn't support it.
+type checksApi interface {
+	PostCheck(ctx context.Context, changeID, revision string, check checkInput) error
+}
+
+// PostCheck creates or updates check on the revision. The checks plugin
+// responds 201 when it creates the check and 200 when it updates it.
+func (c restApi) PostCheck(ctx context.Context, changeID, revision string, check checkInput) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/changes/%s/revisions/%s/checks/",
+		url.PathEscape(changeID), url.PathEscape(revision)), check, nil)
+}
+
+// postCheck reports the build as the checker's check on the revision.
+func postCheck(
+	req resource.OutRequest,
+	checks checksApi,
+	ctx context.Context,
+	params outParams,
+	ver Version,
+	message string,
+	buildUrl string,
+) error {
+	check := checkInput{
+		CheckerUuid: params.CheckerUuid,
+		State:       params.CheckState,
+		Message:     truncateMessage(message, maxMessageLength(params)),
+		Url:         buildUrl,
+	}
+	now := time.Now().UTC().Format(timeStampLayout)
+	if validCheckStates[check.State] {
+		check.Finished = now
+	} else if check.State == "RUNNING" {
+		check.Started = now
+	}
+	err := checks.PostCheck(ctx, ver.ChangeId, ver.Revision, check)
+	if err != nil {
+		return fmt.Errorf("error posting check: %v", err)
+	}
+	req.AddResponseMetadata("check", check.State)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func TestOutCheck(t *testing.T) {
+	os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+	defer os.Unsetenv("ATC_EXTERNAL_URL")
+	testGerritLastReviewInput = nil
+
+	_, metadata := testOut(t, Source{}, outParams{
+		CheckerUuid: "concourse:build",
+		CheckState:  "RUNNING",
+		Message:     "Build started",
+	})
+	assert.Nil(t, testGerritLastReviewInput)
+	assert.Equal(t, "outChange", testGerritLastChangeId)
+	assert.Equal(t, "outRev", testGerritLastRevision)
+	check := testGerritLastCheckInput
+	if assert.NotNil(t, check) {
+		assert.Equal(t, "concourse:build", check.CheckerUuid)
+		assert.Equal(t, "RUNNING", check.State)
+		assert.Equal(t, "Build started", check.Message)
+		assert.Contains(t, check.Url, "https://ci.example.com/teams/")
+		assert.NotEmpty(t, check.Started)
+		assert.Empty(t, check.Finished)
+	}
+	assert.Contains(t, metadata, resource.MetadataField{Name: "check", Value: "RUNNING"})
+
+	testOut(t, Source{}, outParams{
+		CheckerUuid: "concourse:build",
+		CheckState:  "FAILED",
+		Message:     "Build failed",
+	})
+	check = testGerritLastCheckInput
+	if assert.NotNil(t, check) {
+		assert.Equal(t, "FAILED", check.State)
+		assert.Empty(t, check.Started)
+		assert.NotEmpty(t, check.Finished)
+	}
+}
+
+func TestOutCheckInvalid(t *testing.T) {
+	err := testOutError(t, Source{}, outParams{CheckerUuid: "concourse:build", CheckState: "DONE"})
+	assert.Contains(t, err.Error(), `invalid check_state "DONE"`)
+
+	err = testOutError(t, Source{Api: "ssh"}, outParams{CheckerUuid: "concourse:build", CheckState: "FAILED"})
+	assert.Contains(t, err.Error(), `checker_uuid is not supported by api "ssh"`)
+
+	for _, params := range []outParams{
+		{Labels: map[string]int{"Verified": 1}},
+		{LabelsFile: "labels.json"},
+		{JunitLabel: "Verified"},
+		{CommentsFile: "comments.json"},
+		{Reviewers: []string{"jane@example.com"}},
+		{Ccs: []string{"jane@example.com"}},
+		{ReviewersFile: "reviewers.txt"},
+		{Idempotent: true},
+	} {
+		params.CheckerUuid = "concourse:build"
+		params.CheckState = "FAILED"
+		err = testOutError(t, Source{}, params)
+		assert.Contains(t, err.Error(), "can't be used with checker_uuid")
+	}
+}
+
+func TestOutCheckMessageTruncated(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		CheckerUuid:      "concourse:build",
+		CheckState:       "FAILED",
+		Message:          strings.Repeat("x", 100),
+		MaxMessageLength: 50,
+	})
+	check := testGerritLastCheckInput
+	if assert.NotNil(t, check) {
+		assert.Len(t, check.Message, 50)
+	}
+}
@@ -0,0 +1,545 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxComments = 50
+	defaultRobotId     = "concourse"
+)
+
+// finding is a static-analysis result on a file, from a comments_file.
+// Lines are 1-based and characters 0-based, as in Gerrit.
+type finding struct {
+	Path           string      `json:"path"`
+	Line           int         `json:"line"`
+	EndLine        int         `json:"end_line"`
+	StartCharacter int         `json:"start_character"`
+	EndCharacter   int         `json:"end_character"`
+	Message        string      `json:"message"`
+	Severity       string      `json:"severity"`
+	Rule           string      `json:"rule"`
+	Url            string      `json:"url"`
+	Fix            *findingFix `json:"fix"`
+
+	// Tool that reported the finding, used as the robot comment id.
+	Tool string `json:"-"`
+}
+
+type findingFix struct {
+	Description  string               `json:"description"`
+	Replacements []findingReplacement `json:"replacements"`
+}
+
+type findingReplacement struct {
+	Path           string `json:"path"`
+	Line           int    `json:"line"`
+	EndLine        int    `json:"end_line"`
+	StartCharacter int    `json:"start_character"`
+	EndCharacter   int    `json:"end_character"`
+	Replacement    string `json:"replacement"`
+}
+
+// commentRange returns the range of the finding, or nil if it covers a
+// single whole line. Ranges of whole lines end at the start of the line after
+// the last, so the last line is covered.
+func (f finding) commentRange() *commentRange {
+	if f.StartCharacter == 0 && f.EndCharacter == 0 {
+		if f.EndLine <= f.Line {
+			return nil
+		}
+		return &commentRange{
+			StartLine: f.Line,
+			EndLine:   f.EndLine + 1,
+		}
+	}
+	r := &commentRange{
+		StartLine:      f.Line,
+		StartCharacter: f.StartCharacter,
+		EndLine:        f.EndLine,
+		EndCharacter:   f.EndCharacter,
+	}
+	if r.EndLine == 0 {
+		r.EndLine = r.StartLine
+	}
+	return r
+}
+
+// severityRank orders findings so the most severe are kept under
+// max_comments.
+var severityRank = map[string]int{
+	"error":   0,
+	"warning": 1,
+	"info":    2,
+}
+
+func (f finding) rank() int {
+	if rank, ok := severityRank[f.Severity]; ok {
+		return rank
+	}
+	return len(severityRank)
+}
+
+// readFindings reads a comments_file in format ("sarif", "checkstyle" or
+// "json"; detected from the contents if empty). Absolute paths are made
+// relative to repoDir.
+func readFindings(path, format, repoDir string) ([]finding, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading comments file %q: %v", path, err)
+	}
+	if format == "" {
+		format = detectFindingsFormat(data)
+	}
+
+	var findings []finding
+	switch format {
+	case "sarif":
+		findings, err = parseSarif(data)
+	case "checkstyle":
+		findings, err = parseCheckstyle(data)
+	case "json":
+		err = json.Unmarshal(data, &findings)
+	default:
+		return nil, fmt.Errorf("unknown comments_format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s comments file %q: %v", format, path, err)
+	}
+
+	for i := range findings {
+		findings[i].Path = findingPath(findings[i].Path, repoDir)
+		if fix := findings[i].Fix; fix != nil {
+			for j := range fix.Replacements {
+				if fix.Replacements[j].Path == "" {
+					fix.Replacements[j].Path = findings[i].Path
+				} else {
+					fix.Replacements[j].Path = findingPath(fix.Replacements[j].Path, repoDir)
+				}
+			}
+		}
+	}
+	return findings, nil
+}
+
+func detectFindingsFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("<")) {
+		return "checkstyle"
+	}
+	var sarif struct {
+		Runs json.RawMessage `json:"runs"`
+	}
+	if bytes.HasPrefix(data, []byte("{")) && json.Unmarshal(data, &sarif) == nil && sarif.Runs != nil {
+		return "sarif"
+	}
+	return "json"
+}
+
+// findingPath cleans a reported path into one relative to the repository.
+func findingPath(path, repoDir string) string {
+	path = strings.TrimPrefix(path, "file://")
+	if filepath.IsAbs(path) && repoDir != "" {
+		if absRepoDir, err := filepath.Abs(repoDir); err == nil {
+			if rel, err := filepath.Rel(absRepoDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// See: https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Name string `json:"name"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleId    string       `json:"ruleId"`
+			Level     string       `json:"level"`
+			Message   sarifMessage `json:"message"`
+			HelpUri   string       `json:"helpUri"`
+			Locations []struct {
+				PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+			} `json:"locations"`
+			Fixes []struct {
+				Description     sarifMessage `json:"description"`
+				ArtifactChanges []struct {
+					ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+					Replacements     []struct {
+						DeletedRegion   sarifRegion `json:"deletedRegion"`
+						InsertedContent struct {
+							Text string `json:"text"`
+						} `json:"insertedContent"`
+					} `json:"replacements"`
+				} `json:"artifactChanges"`
+			} `json:"fixes"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifArtifactLocation struct {
+	Uri string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+// sarifLevels maps SARIF result levels to severities.
+var sarifLevels = map[string]string{
+	"":        "warning",
+	"error":   "error",
+	"warning": "warning",
+	"note":    "info",
+	"none":    "info",
+}
+
+func parseSarif(data []byte) ([]finding, error) {
+	var log sarifLog
+	err := json.Unmarshal(data, &log)
+	if err != nil {
+		return nil, err
+	}
+	var findings []finding
+	for _, run := range log.Runs {
+		for _, result := range run.Results {
+			if len(result.Locations) == 0 {
+				continue
+			}
+			location := result.Locations[0].PhysicalLocation
+			f := finding{
+				Path:     location.ArtifactLocation.Uri,
+				Message:  result.Message.Text,
+				Severity: sarifLevels[result.Level],
+				Rule:     result.RuleId,
+				Url:      result.HelpUri,
+				Tool:     run.Tool.Driver.Name,
+			}
+			f.Line, f.StartCharacter, f.EndLine, f.EndCharacter = location.Region.lines()
+			if len(result.Fixes) > 0 {
+				fix := result.Fixes[0]
+				f.Fix = &findingFix{Description: fix.Description.Text}
+				for _, change := range fix.ArtifactChanges {
+					for _, r := range change.Replacements {
+						replacement := findingReplacement{
+							Path:        change.ArtifactLocation.Uri,
+							Replacement: r.InsertedContent.Text,
+						}
+						replacement.Line, replacement.StartCharacter,
+							replacement.EndLine, replacement.EndCharacter = r.DeletedRegion.lines()
+						f.Fix.Replacements = append(f.Fix.Replacements, replacement)
+					}
+				}
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// lines converts the region's 1-based columns to 0-based characters.
+func (r sarifRegion) lines() (line, startCharacter, endLine, endCharacter int) {
+	line = r.StartLine
+	if r.StartColumn > 0 {
+		startCharacter = r.StartColumn - 1
+	}
+	if r.EndColumn > 0 {
+		endLine = r.EndLine
+		if endLine == 0 {
+			endLine = line
+		}
+		endCharacter = r.EndColumn - 1
+	} else if r.EndLine > line {
+		endLine = r.EndLine
+	}
+	return
+}
+
+// See: https://checkstyle.org/
+type checkstyleReport struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int    `xml:"line,attr"`
+			Column   int    `xml:"column,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+func parseCheckstyle(data []byte) ([]finding, error) {
+	var report checkstyleReport
+	err := xml.Unmarshal(data, &report)
+	if err != nil {
+		return nil, err
+	}
+	var findings []finding
+	for _, file := range report.Files {
+		for _, e := range file.Errors {
+			severity := e.Severity
+			if severity == "ignore" {
+				continue
+			}
+			findings = append(findings, finding{
+				Path:     file.Name,
+				Line:     e.Line,
+				Message:  e.Message,
+				Severity: severity,
+				Rule:     e.Source,
+				Tool:     "checkstyle",
+			})
+		}
+	}
+	return findings, nil
+}
+
+// changedLines maps each file to its lines added or modified by HEAD of the
+// git checkout in dir, relative to its first parent.
+type changedLines map[string]map[int]bool
+
+var diffHunkRe = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+func readChangedLines(dir string) (changedLines, error) {
+	output, err := gitOutput(dir, "diff-tree", "-r", "-p", "--root", "-m", "--first-parent",
+		"--unified=0", "--no-color", "--no-ext-diff", "--no-prefix", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	return parseChangedLines(output), nil
+}
+
+func parseChangedLines(diff []byte) changedLines {
+	lines := changedLines{}
+	var file string
+	for _, line := range strings.Split(string(diff), "\n") {
+		if strings.HasPrefix(line, "+++ ") {
+			file = strings.TrimPrefix(line, "+++ ")
+			if file == "/dev/null" {
+				file = ""
+			} else {
+				lines[file] = map[int]bool{}
+			}
+			continue
+		}
+		match := diffHunkRe.FindStringSubmatch(line)
+		if match == nil || file == "" {
+			continue
+		}
+		start, _ := strconv.Atoi(match[1])
+		count := 1
+		if match[2] != "" {
+			count, _ = strconv.Atoi(match[2])
+		}
+		for i := start; i < start+count; i++ {
+			lines[file][i] = true
+		}
+	}
+	return lines
+}
+
+// contains reports whether any line of f was changed. Findings without a
+// line match any changed file.
+func (cl changedLines) contains(f finding) bool {
+	fileLines, ok := cl[f.Path]
+	if !ok {
+		return false
+	}
+	if f.Line == 0 {
+		return true
+	}
+	endLine := f.EndLine
+	if endLine < f.Line {
+		endLine = f.Line
+	}
+	for line := f.Line; line <= endLine; line++ {
+		if fileLines[line] {
+			return true
+		}
+	}
+	return false
+}
+
+// findingComments builds the review comments for findings.
+type findingComments struct {
+	// files is the set of files in the revision; comments on other files
+	// are rejected by Gerrit.
+	files        map[string]bool
+	changedLines changedLines
+	maxComments  int
+	robot        bool
+	robotId      string
+	robotRunId   string
+	url          string
+
+	posted     int
+	notChanged int
+	overLimit  int
+}
+
+// addTo adds comments for findings to review and returns a summary of the
+// findings that weren't posted.
+func (fc *findingComments) addTo(review *reviewInput, findings []finding) string {
+	var kept []finding
+	for _, f := range findings {
+		if !fc.files[f.Path] || (fc.changedLines != nil && !fc.changedLines.contains(f)) {
+			fc.notChanged++
+			continue
+		}
+		kept = append(kept, f)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].rank() < kept[j].rank()
+	})
+	if len(kept) > fc.maxComments {
+		fc.overLimit = len(kept) - fc.maxComments
+		kept = kept[:fc.maxComments]
+	}
+
+	for _, f := range kept {
+		comment := commentInput{
+			Line:    f.Line,
+			Range:   f.commentRange(),
+			Message: f.commentMessage(),
+		}
+		if comment.Range != nil {
+			// Gerrit requires a ranged comment's line to be the range's end.
+			comment.Line = comment.Range.EndLine
+		}
+		if fc.robot {
+			if review.RobotComments == nil {
+				review.RobotComments = map[string][]robotCommentInput{}
+			}
+			review.RobotComments[f.Path] = append(review.RobotComments[f.Path], fc.robotComment(f, comment))
+		} else {
+			if review.Comments == nil {
+				review.Comments = map[string][]commentInput{}
+			}
+			review.Comments[f.Path] = append(review.Comments[f.Path], comment)
+		}
+		fc.posted++
+	}
+
+	var skipped []string
+	if fc.notChanged > 0 {
+		skipped = append(skipped, fmt.Sprintf("%d outside the change", fc.notChanged))
+	}
+	if fc.overLimit > 0 {
+		skipped = append(skipped, fmt.Sprintf("%d over the limit of %d", fc.overLimit, fc.maxComments))
+	}
+	if len(skipped) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d findings not commented: %s.",
+		fc.notChanged+fc.overLimit, len(findings), strings.Join(skipped, ", "))
+}
+
+func (fc *findingComments) robotComment(f finding, comment commentInput) robotCommentInput {
+	robotId := fc.robotId
+	if robotId == "" {
+		robotId = f.Tool
+	}
+	if robotId == "" {
+		robotId = defaultRobotId
+	}
+	url := f.Url
+	if url == "" {
+		url = fc.url
+	}
+	robotComment := robotCommentInput{
+		commentInput: comment,
+		RobotId:      robotId,
+		RobotRunId:   fc.robotRunId,
+		Url:          url,
+	}
+	if f.Rule != "" {
+		robotComment.Properties = map[string]string{"rule": f.Rule}
+	}
+	if f.Fix != nil && len(f.Fix.Replacements) > 0 {
+		suggestion := fixSuggestion{Description: f.Fix.Description}
+		if suggestion.Description == "" {
+			suggestion.Description = "Suggested fix"
+		}
+		for _, r := range f.Fix.Replacements {
+			suggestion.Replacements = append(suggestion.Replacements, fixReplacement{
+				Path:        r.Path,
+				Range:       r.commentRange(),
+				Replacement: r.Replacement,
+			})
+		}
+		robotComment.FixSuggestions = []fixSuggestion{suggestion}
+	}
+	return robotComment
+}
+
+// commentRange returns the replaced range; a replacement without
+// characters replaces whole lines.
+func (r findingReplacement) commentRange() commentRange {
+	cr := commentRange{
+		StartLine:      r.Line,
+		StartCharacter: r.StartCharacter,
+		EndLine:        r.EndLine,
+		EndCharacter:   r.EndCharacter,
+	}
+	if cr.EndLine == 0 {
+		cr.EndLine = cr.StartLine
+	}
+	if r.EndCharacter == 0 && r.StartCharacter == 0 {
+		// Up to the start of the next line
+		cr.EndLine++
+	}
+	return cr
+}
+
+func (f finding) commentMessage() string {
+	message := f.Message
+	if f.Severity != "" {
+		severity := strings.ToUpper(f.Severity[:1]) + f.Severity[1:]
+		message = fmt.Sprintf("%s: %s", severity, message)
+	}
+	if f.Rule != "" {
+		message = fmt.Sprintf("%s (%s)", message, f.Rule)
+	}
+	return message
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFindingsSarif(t *testing.T) {
+	findings, err := readFindings(filepath.Join("testdata", "report.sarif"), "", "/src/repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []finding{
+		{
+			Path:           "main.go",
+			Line:           12,
+			StartCharacter: 1,
+			EndLine:        12,
+			EndCharacter:   4,
+			Message:        "this value of err is never used",
+			Severity:       "error",
+			Rule:           "SA4006",
+			Tool:           "staticcheck",
+			Fix: &findingFix{
+				Description: "Remove the assignment",
+				Replacements: []findingReplacement{{
+					Path:           "main.go",
+					Line:           12,
+					StartCharacter: 1,
+					EndLine:        12,
+					EndCharacter:   8,
+					Replacement:    "_ = ",
+				}},
+			},
+		},
+		{
+			Path:     "lib/util.go",
+			Line:     40,
+			Message:  "error strings should not be capitalized",
+			Severity: "info",
+			Rule:     "ST1005",
+			Tool:     "staticcheck",
+		},
+	}, findings)
+}
+
+func TestReadFindingsCheckstyle(t *testing.T) {
+	findings, err := readFindings(filepath.Join("testdata", "checkstyle.xml"), "", "/src/repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []finding{
+		{
+			Path:     "main.go",
+			Line:     3,
+			Message:  "exported function Main should have comment",
+			Severity: "warning",
+			Rule:     "golint",
+			Tool:     "checkstyle",
+		},
+		{
+			Path:     "main.go",
+			Line:     7,
+			Message:  "undefined: foo",
+			Severity: "error",
+			Rule:     "typecheck",
+			Tool:     "checkstyle",
+		},
+	}, findings)
+}
+
+func TestReadFindingsJson(t *testing.T) {
+	path := testCommentsFile(t, `[
+		{"path": "./main.go", "line": 3, "message": "fix me", "severity": "warning",
+		 "fix": {"replacements": [{"line": 3, "replacement": "fixed\n"}]}}
+	]`)
+	findings, err := readFindings(filepath.Join(testTempDir, path), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []finding{{
+		Path:     "main.go",
+		Line:     3,
+		Message:  "fix me",
+		Severity: "warning",
+		Fix: &findingFix{Replacements: []findingReplacement{{
+			Path:        "main.go",
+			Line:        3,
+			Replacement: "fixed\n",
+		}}},
+	}}, findings)
+
+	_, err = readFindings(filepath.Join(testTempDir, path), "yaml", "")
+	assert.EqualError(t, err, `unknown comments_format "yaml"`)
+}
+
+func TestFindingCommentRange(t *testing.T) {
+	for _, test := range []struct {
+		f    finding
+		want *commentRange
+	}{
+		{finding{Line: 5}, nil},
+		{finding{Line: 5, EndLine: 5}, nil},
+		{finding{Line: 5, EndLine: 6}, &commentRange{StartLine: 5, EndLine: 7}},
+		{finding{Line: 4, StartCharacter: 2, EndCharacter: 6},
+			&commentRange{StartLine: 4, StartCharacter: 2, EndLine: 4, EndCharacter: 6}},
+		{finding{Line: 4, EndLine: 6, EndCharacter: 3},
+			&commentRange{StartLine: 4, EndLine: 6, EndCharacter: 3}},
+	} {
+		assert.Equal(t, test.want, test.f.commentRange(), "%+v", test.f)
+	}
+}
+
+func TestParseChangedLines(t *testing.T) {
+	diff := `1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d
+diff --git main.go main.go
+index 1111111..2222222 100644
+--- main.go
++++ main.go
+@@ -3 +3 @@ package main
+-import "fmt"
++import "log"
+@@ -10,0 +11,2 @@ func main() {
++	log.Print("a")
++	log.Print("b")
+@@ -20,2 +22,0 @@ func main() {
+-	old()
+-	old()
+diff --git old.go old.go
+deleted file mode 100644
+--- old.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package main
+`
+	assert.Equal(t, changedLines{
+		"main.go": {3: true, 11: true, 12: true},
+	}, parseChangedLines([]byte(diff)))
+}
+
+func testCommentsFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile(testTempDir, "comments")
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	assert.NoError(t, err)
+	return filepath.Base(f.Name())
+}
+
+const testFindingsJson = `[
+	{"path": "main.go", "line": 3, "message": "minor", "severity": "info"},
+	{"path": "main.go", "line": 5, "end_line": 6, "message": "bad", "severity": "error"},
+	{"path": "lib/util.go", "message": "file level", "severity": "warning", "rule": "R1"},
+	{"path": "unchanged.go", "line": 1, "message": "not in change"}
+]`
+
+func TestOutCommentsFile(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		Message:      "Build failed",
+		CommentsFile: testCommentsFile(t, testFindingsJson),
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, "Build failed\n\n1 of 4 findings not commented: 1 outside the change.", review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {
+			{Line: 7, Range: &commentRange{StartLine: 5, EndLine: 7}, Message: "Error: bad"},
+			{Line: 3, Message: "Info: minor"},
+		},
+		"lib/util.go": {
+			{Message: "Warning: file level (R1)"},
+		},
+	}, review.Comments)
+	assert.Empty(t, review.RobotComments)
+}
+
+func TestOutCommentsMaxComments(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		CommentsFile: testCommentsFile(t, testFindingsJson),
+		MaxComments:  1,
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t,
+		"3 of 4 findings not commented: 1 outside the change, 2 over the limit of 1.",
+		review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {{Line: 7, Range: &commentRange{StartLine: 5, EndLine: 7}, Message: "Error: bad"}},
+	}, review.Comments)
+}
+
+func TestOutCommentsOnlyChangedLines(t *testing.T) {
+	mockGitOutput("diff-tree", "+++ main.go\n@@ -1,0 +6,2 @@\n+a\n+b\n")
+	testOut(t, Source{}, outParams{
+		CommentsFile:     testCommentsFile(t, testFindingsJson),
+		OnlyChangedLines: true,
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, "3 of 4 findings not commented: 3 outside the change.", review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {{Line: 7, Range: &commentRange{StartLine: 5, EndLine: 7}, Message: "Error: bad"}},
+	}, review.Comments)
+}
+
+func TestOutRobotComments(t *testing.T) {
+	findings := `[{"path": "main.go", "line": 4, "start_character": 2, "end_character": 6,
+		"message": "use x", "rule": "R2", "url": "https://lint.example.com/R2",
+		"fix": {"description": "Use x", "replacements": [{"line": 4, "start_character": 2, "end_character": 6, "replacement": "x"}]}}]`
+	os.Setenv("BUILD_ID", "1")
+	testOut(t, Source{}, outParams{
+		CommentsFile:  testCommentsFile(t, findings),
+		RobotComments: true,
+		RobotId:       "lint",
+	})
+	review := testGerritLastReviewInput
+	assert.Empty(t, review.Comments)
+	assert.Equal(t, map[string][]robotCommentInput{
+		"main.go": {{
+			commentInput: commentInput{
+				Line:    4,
+				Range:   &commentRange{StartLine: 4, StartCharacter: 2, EndLine: 4, EndCharacter: 6},
+				Message: "use x (R2)",
+			},
+			RobotId:    "lint",
+			RobotRunId: "1",
+			Url:        "https://lint.example.com/R2",
+			Properties: map[string]string{"rule": "R2"},
+			FixSuggestions: []fixSuggestion{{
+				Description: "Use x",
+				Replacements: []fixReplacement{{
+					Path:        "main.go",
+					Range:       commentRange{StartLine: 4, StartCharacter: 2, EndLine: 4, EndCharacter: 6},
+					Replacement: "x",
+				}},
+			}},
+		}},
+	}, review.RobotComments)
+}
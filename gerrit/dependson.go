@@ -0,0 +1,300 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	dependsOnFooterKey  = "Depends-On"
+	defaultDependsOnDir = ".gerrit_depends_on"
+)
+
+var (
+	changeIdRegexp     = regexp.MustCompile(`^I[0-9a-zA-Z]+$`)
+	changeNumberRegexp = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// dependency is a change from another project named by a Depends-On footer.
+type dependency struct {
+	change *gerrit.ChangeInfo
+	rev    *gerrit.RevisionInfo
+}
+
+// dependsOnRefs returns the values of all Depends-On footers.
+func dependsOnRefs(footers []Footer) []string {
+	var refs []string
+	for _, footer := range footers {
+		if strings.EqualFold(footer.Key, dependsOnFooterKey) {
+			refs = append(refs, footer.Value)
+		}
+	}
+	return refs
+}
+
+func dependsOnDir(params InParams) string {
+	if params.DependsOnDir != "" {
+		return filepath.Clean(params.DependsOnDir)
+	}
+	return defaultDependsOnDir
+}
+
+// checkoutDependsOn checks out every change named by Depends-On footers into
+// a directory per project under the target directory, returning the number
+// of LFS bytes downloaded for them.
+func checkoutDependsOn(
+	req resource.InRequest,
+	client *gerrit.Client,
+	ctx context.Context,
+	authMan *authManager,
+	src Source,
+	params InParams,
+	configArgs map[string]string,
+	change *gerrit.ChangeInfo,
+	footers []Footer,
+) (int64, error) {
+	warnOnly := false
+	switch params.DependsOnMissing {
+	case "", "fail":
+	case "warn":
+		warnOnly = true
+	default:
+		return 0, fmt.Errorf("invalid depends_on_missing %q", params.DependsOnMissing)
+	}
+
+	deps, err := resolveDependsOn(client, ctx, src, change, footers, warnOnly)
+	if err != nil {
+		return 0, err
+	}
+
+	// Source fetch_url and private_key_user only apply to the main project.
+	depSrc := src
+	depSrc.FetchUrl = ""
+	depSrc.PrivateKeyUser = ""
+
+	var lfsBytes int64
+
+	for _, dep := range deps {
+		depPath, ok := params.DependsOnPaths[dep.change.Project]
+		if !ok {
+			depPath = filepath.Join(dependsOnDir(params), dep.change.Project)
+		}
+		depPath = filepath.Clean(depPath)
+		if filepath.IsAbs(depPath) || depPath == ".." ||
+			strings.HasPrefix(depPath, ".."+string(filepath.Separator)) {
+			return 0, fmt.Errorf("depends on path %q for project %q is outside the resource directory",
+				depPath, dep.change.Project)
+		}
+		depDir := filepath.Join(req.TargetDir(), depPath)
+
+		fetchUrl, fetchRef, err := resolveFetchUrlRef(depSrc, dep.rev)
+		if err != nil {
+			return 0, fmt.Errorf("could not resolve fetch args for change %q: %v", dep.change.ID, err)
+		}
+		err = authMan.verifyHostKeys(fetchUrl)
+		if err != nil {
+			return 0, err
+		}
+		err = os.MkdirAll(depDir, 0755)
+		if err != nil {
+			return 0, err
+		}
+		err = checkoutRevision(depDir, depSrc, configArgs, fetchUrl, fetchRef, dep.change.Branch, nil)
+		if err != nil {
+			return 0, fmt.Errorf("error checking out depends on change %d: %v",
+				dep.change.ChangeNumber, err)
+		}
+
+		if params.Lfs {
+			depLfsBytes, err := lfsPull(depDir, params, configArgs)
+			if err != nil {
+				return 0, fmt.Errorf("error pulling LFS objects of depends on change %d: %v",
+					dep.change.ChangeNumber, err)
+			}
+			lfsBytes += depLfsBytes
+		}
+
+		link, err := buildRevisionLink(src, dep.change.ChangeNumber, dep.rev.PatchSetNumber)
+		if err != nil {
+			log.Printf("error building revision link: %v", err)
+		}
+		req.AddResponseMetadata("depends on",
+			fmt.Sprintf("%s %s (%s)", dep.change.Project, link, depPath))
+	}
+	return lfsBytes, nil
+}
+
+// resolveDependsOn follows Depends-On footers starting from change,
+// returning at most one open dependency per project other than change's own.
+// Dependencies that are abandoned or can't be found fail the resolution
+// unless warnOnly is set, in which case they are logged and skipped.
+func resolveDependsOn(
+	client *gerrit.Client,
+	ctx context.Context,
+	src Source,
+	change *gerrit.ChangeInfo,
+	footers []Footer,
+	warnOnly bool,
+) ([]dependency, error) {
+	seen := map[int]bool{change.ChangeNumber: true}
+	projects := map[string]bool{change.Project: true}
+	var deps []dependency
+
+	queue := dependsOnRefs(footers)
+	for len(queue) > 0 {
+		ref := queue[0]
+		queue = queue[1:]
+
+		depChange, err := lookupDependency(client, ctx, src, change.Branch, ref)
+		if err == nil && depChange.Status == "ABANDONED" {
+			err = fmt.Errorf("change %d is abandoned", depChange.ChangeNumber)
+		}
+		if err != nil {
+			err = fmt.Errorf("error resolving Depends-On %q: %v", ref, err)
+			if warnOnly {
+				log.Printf("warning: %v", err)
+				continue
+			}
+			return nil, err
+		}
+
+		if seen[depChange.ChangeNumber] {
+			log.Printf("Depends-On %q: change %d already visited", ref, depChange.ChangeNumber)
+			continue
+		}
+		seen[depChange.ChangeNumber] = true
+
+		if depChange.Status == "MERGED" {
+			log.Printf("Depends-On %q: change %d is already merged", ref, depChange.ChangeNumber)
+			continue
+		}
+
+		rev, ok := depChange.Revisions[depChange.CurrentRevision]
+		if !ok {
+			return nil, fmt.Errorf(
+				"no current revision for Depends-On %q (change %d)", ref, depChange.ChangeNumber)
+		}
+		if rev.Commit != nil {
+			queue = append(queue, dependsOnRefs(parseFooters(rev.Commit.Message))...)
+		}
+
+		if projects[depChange.Project] {
+			log.Printf("Depends-On %q: project %q is already checked out; skipping change %d",
+				ref, depChange.Project, depChange.ChangeNumber)
+			continue
+		}
+		projects[depChange.Project] = true
+		deps = append(deps, dependency{change: depChange, rev: &rev})
+	}
+	return deps, nil
+}
+
+// lookupDependency finds the change named by a Depends-On value, which may be
+// a Change-Id, a change number or a URL to a change on the source Gerrit.
+func lookupDependency(
+	client *gerrit.Client,
+	ctx context.Context,
+	src Source,
+	branch string,
+	ref string,
+) (*gerrit.ChangeInfo, error) {
+	opt := gerrit.QueryChangesOpt{
+		Fields: []string{"CURRENT_REVISION", "CURRENT_COMMIT"},
+	}
+
+	if changeIdRegexp.MatchString(ref) {
+		changes, err := client.QueryChanges(ctx, "change:"+ref, opt)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			return nil, fmt.Errorf("no visible change with Change-Id %q", ref)
+		}
+		// The same Change-Id may be uploaded to several branches; prefer
+		// the one on our branch, then any that is still open.
+		best := changes[0]
+		for _, c := range changes {
+			if c.Branch == branch && c.Status != "ABANDONED" {
+				return c, nil
+			}
+			if best.Status == "ABANDONED" && c.Status != "ABANDONED" {
+				best = c
+			}
+		}
+		return best, nil
+	}
+
+	changeNum, err := parseDependsOnNumber(src, ref)
+	if err != nil {
+		return nil, err
+	}
+	change, err := client.GetChange(ctx, strconv.Itoa(changeNum), opt)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// parseDependsOnNumber extracts the change number from a Depends-On value
+// that is a bare number or a URL like https://review.example.com/c/proj/+/1234
+func parseDependsOnNumber(src Source, ref string) (int, error) {
+	if changeNumberRegexp.MatchString(ref) {
+		return strconv.Atoi(ref)
+	}
+
+	refUrl, err := url.Parse(ref)
+	if err != nil || refUrl.Host == "" {
+		return 0, fmt.Errorf("not a Change-Id, change number or URL")
+	}
+	srcUrl, err := url.Parse(src.Url)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.EqualFold(refUrl.Host, srcUrl.Host) {
+		return 0, fmt.Errorf("URL is not on %s", srcUrl.Host)
+	}
+
+	// Old-style URLs keep the path in the fragment, e.g. /#/c/1234/
+	parts := strings.Split(strings.Trim(refUrl.Path+"/"+refUrl.Fragment, "/"), "/")
+	num := ""
+	for i, part := range parts {
+		if (part == "+" || part == "c") && i+1 < len(parts) &&
+			changeNumberRegexp.MatchString(parts[i+1]) {
+			// Any later components are a patch set or file.
+			num = parts[i+1]
+			break
+		}
+	}
+	if num == "" && changeNumberRegexp.MatchString(parts[len(parts)-1]) {
+		num = parts[len(parts)-1]
+	}
+	if num == "" {
+		return 0, fmt.Errorf("no change number in URL")
+	}
+	return strconv.Atoi(num)
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func testMutateChange(testNumber int, project, status, footers string) {
+	testChangeMutators[testNumber] = func(change *gerrit.ChangeInfo) {
+		if project != "" {
+			change.Project = project
+		}
+		change.Status = status
+		for _, rev := range change.Revisions {
+			rev.Commit.Message += footers
+		}
+	}
+}
+
+func testSetupDependsOn(t *testing.T, abandonedStatus string) {
+	testMutateChange(1, "", "NEW", "\nDepends-On: Itestchange2")
+	testMutateChange(2, "libproject", "NEW", "\nDepends-On: Itestchange3\nDepends-On: Itestchange1")
+	testMutateChange(3, "otherproject", abandonedStatus, "")
+	t.Cleanup(func() {
+		testChangeMutators = make(map[int]func(*gerrit.ChangeInfo))
+	})
+	testGitCalls = nil
+}
+
+func testGitInitDirs() []string {
+	var dirs []string
+	for _, args := range testGitCalls {
+		if len(args) == 3 && args[0] == "-C" && args[2] == "init" {
+			dirs = append(dirs, args[1])
+		}
+	}
+	return dirs
+}
+
+func TestInDependsOn(t *testing.T) {
+	testSetupDependsOn(t, "NEW")
+
+	_, metadata := testIn(t, Source{}, testInVersion, InParams{DependsOn: true})
+	assert.Equal(t, []string{
+		testInDestDir,
+		filepath.Join(testInDestDir, defaultDependsOnDir, "libproject"),
+		filepath.Join(testInDestDir, defaultDependsOnDir, "otherproject"),
+	}, testGitInitDirs())
+
+	var dependsOn []string
+	for _, field := range metadata {
+		if field.Name == "depends on" {
+			dependsOn = append(dependsOn, field.Value)
+		}
+	}
+	assert.Len(t, dependsOn, 2)
+
+	exclude, err := ioutil.ReadFile(filepath.Join(testInDestDir, ".git", "info", "exclude"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(exclude), "/"+defaultDependsOnDir+"\n")
+}
+
+func TestInDependsOnPaths(t *testing.T) {
+	testSetupDependsOn(t, "NEW")
+
+	testIn(t, Source{}, testInVersion, InParams{
+		DependsOn:      true,
+		DependsOnDir:   "deps",
+		DependsOnPaths: map[string]string{"libproject": "lib"},
+	})
+	assert.Equal(t, []string{
+		testInDestDir,
+		filepath.Join(testInDestDir, "lib"),
+		filepath.Join(testInDestDir, "deps", "otherproject"),
+	}, testGitInitDirs())
+}
+
+func TestInDependsOnAbandoned(t *testing.T) {
+	testSetupDependsOn(t, "ABANDONED")
+
+	destDir, err := ioutil.TempDir(testTempDir, "repo")
+	assert.NoError(t, err)
+	fetch := true
+	req := testRequest{
+		Source:  Source{Url: testGerritUrl, Fetch: &fetch},
+		Version: testInVersion,
+		Params:  InParams{DependsOn: true},
+	}
+	err = resource.TestInFunc(t, req, nil, destDir, in)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "abandoned")
+}
+
+func TestInDependsOnAbandonedWarn(t *testing.T) {
+	testSetupDependsOn(t, "ABANDONED")
+
+	testIn(t, Source{}, testInVersion, InParams{DependsOn: true, DependsOnMissing: "warn"})
+	assert.Equal(t, []string{
+		testInDestDir,
+		filepath.Join(testInDestDir, defaultDependsOnDir, "libproject"),
+	}, testGitInitDirs())
+}
+
+func TestParseDependsOnNumber(t *testing.T) {
+	src := Source{Url: "https://review.example.com"}
+	for ref, want := range map[string]int{
+		"1234":                                               1234,
+		"https://review.example.com/1234":                    1234,
+		"https://review.example.com/c/1234/2":                1234,
+		"https://review.example.com/c/my/proj/+/1234":        1234,
+		"https://review.example.com/c/my/proj/+/1234/3/a.go": 1234,
+		"https://review.example.com/#/c/1234/":               1234,
+	} {
+		num, err := parseDependsOnNumber(src, ref)
+		assert.NoError(t, err, ref)
+		assert.Equal(t, want, num, ref)
+	}
+
+	for _, ref := range []string{
+		"https://other.example.com/c/1234",
+		"https://review.example.com/c/proj/+/",
+		"not a ref",
+	} {
+		_, err := parseDependsOnNumber(src, ref)
+		assert.Error(t, err, ref)
+	}
+}
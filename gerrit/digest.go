@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestChallenge is a server's digest auth challenge. It's answered for
+// each request with an increasing nonce count until the server sends a new
+// one.
+// See: https://www.rfc-editor.org/rfc/rfc7616
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       bool
+	nc        int
+}
+
+// parseDigestChallenge parses a WWW-Authenticate header, returning nil if
+// it isn't a digest challenge.
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil, nil
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(header, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	dc := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	if _, err := dc.hash(); err != nil {
+		return nil, err
+	}
+	if qop, ok := params["qop"]; ok {
+		for _, option := range strings.Split(qop, ",") {
+			if strings.TrimSpace(option) == "auth" {
+				dc.qop = true
+			}
+		}
+		if !dc.qop {
+			return nil, fmt.Errorf("unsupported digest qop %q", qop)
+		}
+	}
+	return dc, nil
+}
+
+func (dc *digestChallenge) hash() (func() hash.Hash, error) {
+	switch strings.ToUpper(dc.algorithm) {
+	case "", "MD5":
+		return md5.New, nil
+	case "SHA-256":
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", dc.algorithm)
+	}
+}
+
+// authorization returns the Authorization header answering the challenge
+// for a request.
+func (dc *digestChallenge) authorization(username, password, method, uri string) (string, error) {
+	cnonce := make([]byte, 16)
+	if _, err := rand.Read(cnonce); err != nil {
+		return "", err
+	}
+	dc.nc++
+	return dc.authorizationWith(username, password, method, uri, hex.EncodeToString(cnonce))
+}
+
+func (dc *digestChallenge) authorizationWith(username, password, method, uri, cnonce string) (string, error) {
+	newHash, err := dc.hash()
+	if err != nil {
+		return "", err
+	}
+	h := func(s string) string {
+		hash := newHash()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	ha1 := h(username + ":" + dc.realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		username, dc.realm, dc.nonce, uri)
+	if dc.qop {
+		nc := fmt.Sprintf("%08x", dc.nc)
+		response := h(strings.Join([]string{ha1, dc.nonce, nc, cnonce, "auth", ha2}, ":"))
+		header += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, response, nc, cnonce)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, h(ha1+":"+dc.nonce+":"+ha2))
+	}
+	if dc.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, dc.opaque)
+	}
+	if dc.algorithm != "" {
+		header += ", algorithm=" + dc.algorithm
+	}
+	return header, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// See: https://www.rfc-editor.org/rfc/rfc7616#section-3.9.1
+const testDigestChallenge = `Digest realm="http-auth@example.org", qop="auth, auth-int", ` +
+	`algorithm=%s, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+	`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+
+func TestDigestAuthorization(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		dc, err := parseDigestChallenge(strings.Replace(testDigestChallenge, "%s", test.algorithm, 1))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		dc.nc = 1
+		header, err := dc.authorizationWith("Mufasa", "Circle of Life", "GET", "/dir/index.html",
+			"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		assert.NoError(t, err)
+		assert.Contains(t, header, `response="`+test.response+`"`)
+		assert.Contains(t, header, "qop=auth, nc=00000001")
+		assert.Contains(t, header, "algorithm="+test.algorithm)
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	dc, err := parseDigestChallenge(`Basic realm="Gerrit"`)
+	assert.NoError(t, err)
+	assert.Nil(t, dc)
+
+	_, err = parseDigestChallenge(`Digest realm="Gerrit", nonce="n", algorithm=SHA-512-256`)
+	assert.Error(t, err)
+
+	_, err = parseDigestChallenge(`Digest realm="Gerrit", nonce="n", qop="auth-int"`)
+	assert.Error(t, err)
+}
+
+func TestOutDigestAuthChallengeReused(t *testing.T) {
+	var reviews []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/review") {
+			reviews = append(reviews, r.Header.Get("Authorization"))
+		}
+		testGerritHandler(w, r)
+	}))
+	defer server.Close()
+
+	src := Source{Url: server.URL, Username: "bob", Password: "dog", DigestAuth: true}
+	authMan := newAuthManager(src)
+	defer authMan.cleanup()
+	c, err := gerritApiClient(src, authMan)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.SetReview(context.Background(), "outChange", "outRev", reviewInput{Message: "hi"}))
+	}
+	// The first review is challenged; the second reuses the challenge.
+	if assert.Len(t, reviews, 3) {
+		assert.Empty(t, reviews[0])
+		assert.Contains(t, reviews[1], `Digest username="bob", realm="Gerrit", nonce="foobar"`)
+		assert.Contains(t, reviews[2], `Digest username="bob", realm="Gerrit", nonce="foobar"`)
+	}
+}
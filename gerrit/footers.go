@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	footerLineRegexp = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)\s*:\s*(.*)$`)
+
+	// Trailers that git and Gerrit add themselves; a footer block containing
+	// one of these may also contain some non-footer lines.
+	knownFooterKeys = []string{"Change-Id", "Signed-off-by", "Reviewed-on", "Cherry-picked-from"}
+)
+
+// Footer is a single git trailer from a commit message.
+type Footer struct {
+	Key   string
+	Value string
+}
+
+// Footers maps footer keys to all of their values, in commit message order.
+type Footers map[string][]string
+
+func (f Footers) WriteToFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(f)
+}
+
+// parseFooters returns the trailers in the last paragraph of a commit
+// message, following the same rules as git interpret-trailers: folded
+// continuation lines are joined with a single space, and keys are matched
+// case-insensitively, keeping the spelling of their first occurrence.
+func parseFooters(message string) []Footer {
+	paragraphs := strings.Split(
+		strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n")), "\n\n")
+	// The subject alone never contains footers.
+	if len(paragraphs) < 2 {
+		return nil
+	}
+	lines := strings.Split(strings.Trim(paragraphs[len(paragraphs)-1], "\n"), "\n")
+
+	var footers []Footer
+	keys := make(map[string]string)
+	otherLines := 0
+	known := false
+	folding := false
+	for _, line := range lines {
+		if folding && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			last := &footers[len(footers)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			continue
+		}
+		match := footerLineRegexp.FindStringSubmatch(line)
+		folding = match != nil
+		if match == nil {
+			otherLines++
+			continue
+		}
+		key := match[1]
+		if k, ok := keys[strings.ToLower(key)]; ok {
+			key = k
+		} else {
+			keys[strings.ToLower(key)] = key
+		}
+		for _, k := range knownFooterKeys {
+			if strings.EqualFold(k, key) {
+				known = true
+			}
+		}
+		footers = append(footers, Footer{Key: key, Value: strings.TrimSpace(match[2])})
+	}
+
+	// Like git, tolerate non-footer lines only alongside a known footer and
+	// when at least a quarter of the block is footers.
+	if otherLines > 0 && (!known || len(footers)*3 < otherLines) {
+		return nil
+	}
+	return footers
+}
+
+func footersByKey(footers []Footer) Footers {
+	byKey := make(Footers)
+	for _, footer := range footers {
+		byKey[footer.Key] = append(byKey[footer.Key], footer.Value)
+	}
+	return byKey
+}
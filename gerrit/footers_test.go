@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFooters(t *testing.T) {
+	footers := parseFooters("Subject\n\nBody text.\n\n" +
+		"Bug: 123\n" +
+		"Release-Note: Fixes a long\n" +
+		"  standing issue\n" +
+		"bug: 456\n" +
+		"Change-Id: I1234\n")
+	assert.Equal(t, []Footer{
+		{Key: "Bug", Value: "123"},
+		{Key: "Release-Note", Value: "Fixes a long standing issue"},
+		{Key: "Bug", Value: "456"},
+		{Key: "Change-Id", Value: "I1234"},
+	}, footers)
+	assert.Equal(t, Footers{
+		"Bug":          {"123", "456"},
+		"Release-Note": {"Fixes a long standing issue"},
+		"Change-Id":    {"I1234"},
+	}, footersByKey(footers))
+}
+
+func TestParseFootersSubjectOnly(t *testing.T) {
+	assert.Empty(t, parseFooters("Bug: 123"))
+}
+
+func TestParseFootersNotTrailerBlock(t *testing.T) {
+	assert.Empty(t, parseFooters("Subject\n\nThis paragraph mentions\nTest: foo\nin passing."))
+}
+
+func TestParseFootersMixedWithKnownFooter(t *testing.T) {
+	footers := parseFooters("Subject\n\n" +
+		"Depends-On: I5678\n" +
+		"(cherry picked from commit abc)\n" +
+		"Change-Id: I1234")
+	assert.Equal(t, []Footer{
+		{Key: "Depends-On", Value: "I5678"},
+		{Key: "Change-Id", Value: "I1234"},
+	}, footers)
+}
@@ -20,6 +20,39 @@ import (
 	"golang.org/x/build/gerrit"
 )
 
+// gerritApi is the part of the Gerrit API used by check and out, so it can be
+// served over ssh.
+type gerritApi interface {
+	QueryChanges(ctx context.Context, q string, opts ...gerrit.QueryChangesOpt) ([]*gerrit.ChangeInfo, error)
+	GetChange(ctx context.Context, changeID string, opts ...gerrit.QueryChangesOpt) (*gerrit.ChangeInfo, error)
+	ListChangeComments(ctx context.Context, changeID string) (map[string][]gerrit.CommentInfo, error)
+	ListFiles(ctx context.Context, changeID, revision string) (map[string]*gerrit.FileInfo, error)
+	QueryAccounts(ctx context.Context, q string, opts ...gerrit.QueryAccountsOpt) ([]*gerrit.AccountInfo, error)
+	SetReview(ctx context.Context, changeID, revision string, review reviewInput) error
+	SetHashtags(ctx context.Context, changeID string, hashtags gerrit.HashtagsInput) ([]string, error)
+	SetTopic(ctx context.Context, changeID, topic string) error
+}
+
+// gerritApiClient returns a client for the source's api.
+func gerritApiClient(src Source, authMan *authManager) (gerritApi, error) {
+	switch src.Api {
+	case "", "rest":
+		c, err := gerritClient(src, authMan)
+		if err != nil {
+			return nil, err
+		}
+		return restApi{c, src.Url, authMan}, nil
+	case "ssh":
+		c, err := newSshClient(src, authMan)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown api %q", src.Api)
+	}
+}
+
 func gerritClient(src Source, authMan *authManager) (*gerrit.Client, error) {
 	if src.Url == "" {
 		return nil, fmt.Errorf("source url is required")
@@ -28,12 +61,16 @@ func gerritClient(src Source, authMan *authManager) (*gerrit.Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gerrit.NewClient(src.Url, auth), nil
-
+	client := gerrit.NewClient(src.Url, auth)
+	client.HTTPClient, err = gerritHttpClient(src, authMan)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 func getVersionChangeRevision(
-	client *gerrit.Client,
+	client gerritApi,
 	ctx context.Context,
 	ver Version,
 	extraFields ...string,
@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -24,6 +25,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -35,18 +37,41 @@ import (
 const (
 	gerritVersionFilename  = ".gerrit_version.json"
 	gerritPatchsetFilename = ".gerrit_patchset.json"
+	gerritChangeFilename   = ".gerrit_change.json"
+	gerritFootersFilename  = ".gerrit_footers.json"
 )
 
 var (
 	defaultFetchProtocols = []string{"http", "anonymous http"}
 
+	// Optional sections of .gerrit_change.json and the extra query fields
+	// needed to populate them.
+	changeSectionFields = map[string][]string{
+		"labels":    nil,
+		"reviewers": {"REVIEWER_UPDATES"},
+		"messages":  {"MESSAGES"},
+		"files":     {"ALL_FILES"},
+		"footers":   {"COMMIT_FOOTERS"},
+		"comments":  nil,
+	}
+
 	// For testing
 	execGit = realExecGit
 )
 
 type InParams struct {
-	Fetch  *bool     `json:"fetch"`
-	Sparse *[]string `json:"sparse"`
+	Fetch          *bool     `json:"fetch"`
+	Sparse         *[]string `json:"sparse"`
+	ChangeSections *[]string `json:"change_sections"`
+
+	DependsOn        bool              `json:"depends_on"`
+	DependsOnDir     string            `json:"depends_on_dir"`
+	DependsOnPaths   map[string]string `json:"depends_on_paths"`
+	DependsOnMissing string            `json:"depends_on_missing"`
+
+	Lfs        bool     `json:"lfs"`
+	LfsInclude []string `json:"lfs_include"`
+	LfsExclude []string `json:"lfs_exclude"`
 }
 
 type PatchSetInfo struct {
@@ -64,6 +89,21 @@ func (psi PatchSetInfo) WriteToFile(path string) error {
 	return json.NewEncoder(f).Encode(psi)
 }
 
+// ChangeSnapshot is the full change written to .gerrit_change.json.
+type ChangeSnapshot struct {
+	*gerrit.ChangeInfo
+	Comments map[string][]gerrit.CommentInfo `json:"comments,omitempty"`
+}
+
+func (cs ChangeSnapshot) WriteToFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(cs)
+}
+
 func init() {
 	resource.RegisterInFunc(in)
 }
@@ -88,11 +128,25 @@ func in(req resource.InRequest) error {
 
 	ctx := context.Background()
 
+	sections, err := changeSections(params)
+	if err != nil {
+		return err
+	}
+	extraFields := []string{"CURRENT_COMMIT", "DETAILED_LABELS"}
+	for _, section := range sections {
+		extraFields = append(extraFields, changeSectionFields[section]...)
+	}
+
 	// Fetch requested version from Gerrit
-	change, rev, err := getVersionChangeRevision(c, ctx, ver, "CURRENT_COMMIT", "DETAILED_LABELS")
+	change, rev, err := getVersionChangeRevision(restApi{c, src.Url, authMan}, ctx, ver, extraFields...)
 	if err != nil {
 		return err
 	}
+	var footers []Footer
+	if rev.Commit != nil {
+		footers = parseFooters(rev.Commit.Message)
+	}
+
 	fetch := false
 	if params.Fetch != nil {
 		fetch = *params.Fetch
@@ -100,6 +154,9 @@ func in(req resource.InRequest) error {
 		fetch = *src.Fetch
 	}
 	if fetch {
+		if src.Depth > 0 && src.ShallowSince != "" {
+			return errors.New("depth and shallow_since cannot be used together")
+		}
 		err = src.WriteSshConfig()
 		if err != nil {
 			return err
@@ -110,21 +167,7 @@ func in(req resource.InRequest) error {
 		}
 		log.Printf("Fetching from %v with %v ssh key len: %v", fetchUrl, src.PrivateKeyUser, len(src.PrivateKey))
 
-		// Prepare destination repo and checkout requested revision
-		log.Printf("Checking out in %v", dir)
-		err = git(dir, "init")
-		if err != nil {
-			return err
-		}
-		err = git(dir, "--version")
-		if err != nil {
-			return err
-		}
-		err = git(dir, "config", "color.ui", "always")
-		if err != nil {
-			return err
-		}
-		err = git(dir, "config", "advice.detachedHead", "false")
+		err = authMan.verifyHostKeys(fetchUrl)
 		if err != nil {
 			return err
 		}
@@ -132,51 +175,37 @@ func in(req resource.InRequest) error {
 		if err != nil {
 			return fmt.Errorf("error getting git config args: %v", err)
 		}
-		for key, value := range configArgs {
-			err = git(req.TargetDir(), "config", key, value)
-			if err != nil {
-				return err
-			}
-		}
-		if params.Sparse != nil {
-			sparseCheckoutArgs := append([]string{"sparse-checkout", "set"}, *params.Sparse...)
-			err = git(dir, sparseCheckoutArgs...)
-			if err != nil {
-				return err
-			}
-		}
-
-		err = git(dir, "remote", "add", "origin", fetchUrl)
+		proxy, ok, err := gitProxy(src, fetchUrl)
 		if err != nil {
 			return err
 		}
-
-		err = git(dir, fetchFlags(src, "fetch", "origin", fetchRef)...)
-		if err != nil {
-			return err
+		if ok {
+			configArgs["http.proxy"] = proxy
 		}
 
-		err = git(dir, "checkout", "FETCH_HEAD")
-		log.Printf("Git checkout %v", dir)
+		// Prepare destination repo and checkout requested revision
+		err = checkoutRevision(dir, src, configArgs, fetchUrl, fetchRef, change.Branch, params.Sparse)
 		if err != nil {
 			return err
 		}
-		err = git(dir, "config", "--global", "--add", "safe.directory", dir)
-		if err != nil {
-			return err
+
+		var lfsBytes int64
+		if params.Lfs {
+			lfsBytes, err = lfsPull(dir, params, configArgs)
+			if err != nil {
+				return fmt.Errorf("error pulling LFS objects: %v", err)
+			}
 		}
 
-		log.Printf("Git skipping submodules %v", src.SkipSubmodules)
-		for _, m := range src.SkipSubmodules {
-			err = git(dir, "config", fmt.Sprintf("submodule.%s.update", m), "none")
+		if params.DependsOn {
+			depLfsBytes, err := checkoutDependsOn(req, c, ctx, authMan, src, params, configArgs, change, footers)
 			if err != nil {
 				return err
 			}
+			lfsBytes += depLfsBytes
 		}
-
-		err = git(dir, fetchFlags(src, "submodule", "update", "--init", "--recursive")...)
-		if err != nil {
-			return err
+		if params.Lfs {
+			req.AddResponseMetadata("lfs bytes downloaded", strconv.FormatInt(lfsBytes, 10))
 		}
 	} else {
 		log.Printf("Writing %s", gerritVersionFilename)
@@ -232,6 +261,11 @@ func in(req resource.InRequest) error {
 		req.AddResponseMetadata("commit message", rev.Commit.Message)
 	}
 
+	for _, footer := range footers {
+		req.AddResponseMetadata("commit footer",
+			fmt.Sprintf("%s: %s", footer.Key, footer.Value))
+	}
+
 	// Write gerrit_version.json
 	gerritVersionPath := filepath.Join(dir, gerritVersionFilename)
 	err = ver.WriteToFile(gerritVersionPath)
@@ -239,13 +273,8 @@ func in(req resource.InRequest) error {
 		return fmt.Errorf("error writing %q: %v", gerritVersionPath, err)
 	}
 
-	proj_and_change_num := strings.Split(ver.ChangeId, "~")
-	change_num, err := strconv.Atoi(proj_and_change_num[1])
-	if err != nil {
-		return fmt.Errorf("Error extracting change number from changeid %s: %v", ver.ChangeId, err)
-	}
 	patchSetInfo := PatchSetInfo{
-		Change:   change_num,
+		Change:   change.ChangeNumber,
 		PatchSet: rev.PatchSetNumber,
 		Branch:   change.Branch,
 	}
@@ -255,27 +284,234 @@ func in(req resource.InRequest) error {
 		return fmt.Errorf("error writing %q: %v", gerritPatchsetPath, err)
 	}
 
-	// Ignore gerrit_version.json file in repo
+	snapshot, err := buildChangeSnapshot(c, ctx, change, sections)
+	if err != nil {
+		return err
+	}
+	gerritChangePath := filepath.Join(dir, gerritChangeFilename)
+	err = snapshot.WriteToFile(gerritChangePath)
+	if err != nil {
+		return fmt.Errorf("error writing %q: %v", gerritChangePath, err)
+	}
+
+	gerritFootersPath := filepath.Join(dir, gerritFootersFilename)
+	err = footersByKey(footers).WriteToFile(gerritFootersPath)
+	if err != nil {
+		return fmt.Errorf("error writing %q: %v", gerritFootersPath, err)
+	}
+
+	// Ignore gerrit_*.json files in repo
 	excludePath := filepath.Join(dir, ".git", "info", "exclude")
 	excludeErr := os.MkdirAll(filepath.Dir(excludePath), 0755)
 	if excludeErr == nil {
 		f, excludeErr := os.OpenFile(excludePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if excludeErr == nil {
 			defer f.Close()
-			_, excludeErr = fmt.Fprintf(f, "\n/%s\n", gerritVersionFilename)
+			excludes := []string{
+				gerritVersionFilename, gerritPatchsetFilename, gerritChangeFilename,
+				gerritFootersFilename,
+			}
+			if params.DependsOn {
+				excludes = append(excludes, dependsOnDir(params))
+			}
+			_, excludeErr = fmt.Fprintf(f, "\n/%s\n", strings.Join(excludes, "\n/"))
 		}
 	}
 	if excludeErr != nil {
-		log.Printf("error adding %q to %q: %v", gerritVersionPath, excludePath, excludeErr)
+		log.Printf("error adding gerrit files to %q: %v", excludePath, excludeErr)
 	}
 
 	return err
 }
 
+func checkoutRevision(
+	dir string,
+	src Source,
+	configArgs map[string]string,
+	fetchUrl, fetchRef, branch string,
+	sparse *[]string,
+) error {
+	log.Printf("Checking out in %v", dir)
+	err := git(dir, "init")
+	if err != nil {
+		return err
+	}
+	err = git(dir, "--version")
+	if err != nil {
+		return err
+	}
+	err = git(dir, "config", "color.ui", "always")
+	if err != nil {
+		return err
+	}
+	err = git(dir, "config", "advice.detachedHead", "false")
+	if err != nil {
+		return err
+	}
+	for key, value := range configArgs {
+		err = git(dir, "config", key, value)
+		if err != nil {
+			return err
+		}
+	}
+	if sparse != nil {
+		sparseCheckoutArgs := append([]string{"sparse-checkout", "set"}, *sparse...)
+		err = git(dir, sparseCheckoutArgs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = git(dir, "remote", "add", "origin", fetchUrl)
+	if err != nil {
+		return err
+	}
+	fetchRefs := []string{fetchRef}
+	if src.SingleBranch {
+		// Track only the target branch, so the change can still be diffed
+		// against it.
+		branchRefspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)
+		err = git(dir, "config", "remote.origin.fetch", branchRefspec)
+		if err != nil {
+			return err
+		}
+		fetchRefs = append(fetchRefs, branchRefspec)
+	}
+	if src.Filter != "" {
+		err = git(dir, "config", "remote.origin.promisor", "true")
+		if err != nil {
+			return err
+		}
+		err = git(dir, "config", "remote.origin.partialclonefilter", src.Filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cache *gitCache
+	if src.CacheDir != "" && src.Filter != "" && !src.CacheShared {
+		// Copying the mirror's objects into the checkout would defeat the
+		// filter.
+		log.Printf("not using cache_dir with filter unless cache_shared is set")
+	} else if src.CacheDir != "" {
+		cache, err = useGitCache(dir, src, configArgs, fetchUrl, fetchRef)
+		if err != nil {
+			log.Printf("error using git cache, fetching without it: %v", err)
+		} else {
+			defer cache.close()
+		}
+	}
+
+	err = git(dir, fetchFlags(src, append([]string{"fetch", "origin"}, fetchRefs...)...)...)
+	if err != nil {
+		return err
+	}
+
+	err = git(dir, "checkout", "FETCH_HEAD")
+	log.Printf("Git checkout %v", dir)
+	if err != nil {
+		return err
+	}
+	if cache != nil && !src.CacheShared {
+		err = cache.dissociate(dir)
+		if err != nil {
+			return err
+		}
+	}
+	err = git(dir, "config", "--global", "--add", "safe.directory", dir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Git skipping submodules %v", src.SkipSubmodules)
+	for _, m := range src.SkipSubmodules {
+		err = git(dir, "config", fmt.Sprintf("submodule.%s.update", m), "none")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Submodules don't share the superproject's config, so pass the auth
+	// config on the command line where git propagates it to child processes.
+	return git(dir, append(gitConfigFlags(configArgs),
+		fetchFlags(src, "submodule", "update", "--init", "--recursive")...)...)
+}
+
+func changeSections(params InParams) ([]string, error) {
+	if params.ChangeSections == nil {
+		sections := make([]string, 0, len(changeSectionFields))
+		for section := range changeSectionFields {
+			sections = append(sections, section)
+		}
+		sort.Strings(sections)
+		return sections, nil
+	}
+	for _, section := range *params.ChangeSections {
+		if _, ok := changeSectionFields[section]; !ok {
+			return nil, fmt.Errorf("unknown change section %q", section)
+		}
+	}
+	return *params.ChangeSections, nil
+}
+
+func buildChangeSnapshot(
+	client *gerrit.Client,
+	ctx context.Context,
+	change *gerrit.ChangeInfo,
+	sections []string,
+) (ChangeSnapshot, error) {
+	included := make(map[string]bool)
+	for _, section := range sections {
+		included[section] = true
+	}
+
+	// DETAILED_LABELS is always requested for metadata, so drop what wasn't
+	// asked for from a copy of the change.
+	info := *change
+	if !included["labels"] {
+		info.Labels = nil
+	}
+	if !included["reviewers"] {
+		info.Reviewers = nil
+		info.ReviewerUpdates = nil
+	}
+	snapshot := ChangeSnapshot{ChangeInfo: &info}
+
+	if included["comments"] {
+		comments, err := client.ListChangeComments(ctx, change.ID)
+		if err != nil {
+			return snapshot, fmt.Errorf("error listing change comments: %v", err)
+		}
+		snapshot.Comments = comments
+	}
+	return snapshot, nil
+}
+
+// fetchFlags appends the source fetch options supported by the given git
+// command, which is either "fetch" or "submodule update".
 func fetchFlags(src Source, flags ...string) []string {
 	if src.Depth > 0 {
 		flags = append(flags, fmt.Sprintf("--depth=%v", src.Depth))
 	}
+	if src.Filter != "" {
+		flags = append(flags, fmt.Sprintf("--filter=%v", src.Filter))
+	}
+	if flags[0] == "submodule" {
+		if src.SingleBranch {
+			flags = append(flags, "--single-branch")
+		}
+		return flags
+	}
+	if src.ShallowSince != "" {
+		flags = append(flags, fmt.Sprintf("--shallow-since=%v", src.ShallowSince))
+	}
+	if src.FetchTags != nil {
+		if *src.FetchTags {
+			flags = append(flags, "--tags")
+		} else {
+			flags = append(flags, "--no-tags")
+		}
+	}
 	return flags
 }
 
@@ -319,6 +555,12 @@ func resolveFetchUrlRef(src Source, rev *gerrit.RevisionInfo) (url, ref string,
 }
 
 func git(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
+
+// gitOutput runs git in dir, returning its output.
+func gitOutput(dir string, args ...string) ([]byte, error) {
 	gitArgs := append([]string{"-C", dir}, args...)
 	log.Printf("git %v", gitArgs)
 	output, err := execGit(gitArgs...)
@@ -326,7 +568,21 @@ func git(dir string, args ...string) error {
 	if err != nil {
 		err = fmt.Errorf("git failed: %v", err)
 	}
-	return err
+	return output, err
+}
+
+// gitConfigFlags returns configArgs as git -c flags, in a stable order.
+func gitConfigFlags(configArgs map[string]string) []string {
+	keys := make([]string, 0, len(configArgs))
+	for key := range configArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	flags := []string{}
+	for _, key := range keys {
+		flags = append(flags, "-c", fmt.Sprintf("%s=%s", key, configArgs[key]))
+	}
+	return flags
 }
 
 func realExecGit(args ...string) ([]byte, error) {
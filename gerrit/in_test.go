@@ -15,8 +15,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -25,6 +27,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/google/concourse-resources/internal/resource"
 )
@@ -39,8 +42,12 @@ var (
 	testInDestDir string
 )
 
-func testIn(t *testing.T, src Source, ver Version, params inParams) (Version, []resource.MetadataField) {
+func testIn(t *testing.T, src Source, ver Version, params InParams) (Version, []resource.MetadataField) {
 	src.Url = testGerritUrl
+	if src.Fetch == nil && params.Fetch == nil {
+		fetch := true
+		src.Fetch = &fetch
+	}
 
 	var err error
 	testInDestDir, err = ioutil.TempDir(testTempDir, "repo")
@@ -56,7 +63,7 @@ func testIn(t *testing.T, src Source, ver Version, params inParams) (Version, []
 }
 
 func TestInResponse(t *testing.T) {
-	ver, metadata := testIn(t, Source{}, testInVersion, inParams{})
+	ver, metadata := testIn(t, Source{}, testInVersion, InParams{})
 	assert.True(t, testInVersion.Equal(ver), "%v != %v", testInVersion, ver)
 	assert.Contains(t, metadata, resource.MetadataField{Name: "project", Value: "testproject"})
 	assert.Contains(t, metadata, resource.MetadataField{Name: "change subject", Value: "Test Subject"})
@@ -64,7 +71,8 @@ func TestInResponse(t *testing.T) {
 	assert.Contains(t, metadata, resource.MetadataField{Name: "revision link", Value: fmt.Sprintf("%s/c/1/1", testGerritUrl)})
 	assert.Contains(t, metadata, resource.MetadataField{Name: "commit author", Value: "Testy McTestface <testy@example.com>"})
 	assert.Contains(t, metadata, resource.MetadataField{Name: "commit subject", Value: "Test Subject"})
-	assert.Contains(t, metadata, resource.MetadataField{Name: "commit message", Value: "Commit message"})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "commit message", Value: testCommitMessage})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "commit footer", Value: "Bug: 123"})
 }
 
 func TestInGitInit(t *testing.T) {
@@ -78,7 +86,7 @@ func TestInGitInit(t *testing.T) {
 		}
 	})
 
-	testIn(t, Source{}, testInVersion, inParams{})
+	testIn(t, Source{}, testInVersion, InParams{})
 	assert.Equal(t, testInDestDir, initDir)
 }
 
@@ -91,7 +99,7 @@ func TestInGitFetch(t *testing.T) {
 		fetchRef = args[idx+2]
 	})
 
-	testIn(t, Source{}, testInVersion, inParams{})
+	testIn(t, Source{}, testInVersion, InParams{})
 	assert.Equal(t, fmt.Sprintf("%s/testproject.git", testGerritUrl), fetchUrl)
 	assert.Equal(t, "refs/changes/1/1/1", fetchRef)
 }
@@ -105,7 +113,7 @@ func TestInGitFetchProtocol(t *testing.T) {
 		fetchRef = args[idx+2]
 	})
 
-	testIn(t, Source{}, testInVersion, inParams{FetchProtocol: "fake"})
+	testIn(t, Source{FetchProtocol: "fake"}, testInVersion, InParams{})
 	assert.Equal(t, "fake://example.com", fetchUrl)
 	assert.Equal(t, "fake/ref", fetchRef)
 }
@@ -119,7 +127,7 @@ func TestInGitFetchUrl(t *testing.T) {
 		fetchRef = args[idx+2]
 	})
 
-	testIn(t, Source{}, testInVersion, inParams{FetchUrl: "some://otherurl"})
+	testIn(t, Source{FetchUrl: "some://otherurl"}, testInVersion, InParams{})
 	assert.Equal(t, "some://otherurl", fetchUrl)
 	assert.Equal(t, "refs/changes/1/1/1", fetchRef)
 }
@@ -135,7 +143,7 @@ func TestInGitCookies(t *testing.T) {
 	})
 
 	cookies := "localhost\tFALSE\t/\tFALSE\t9999999999\tauth\tbar\n"
-	testIn(t, Source{Cookies: cookies}, testInVersion, inParams{})
+	testIn(t, Source{Cookies: cookies}, testInVersion, InParams{})
 	assert.Equal(t, cookies, string(cookiesFileData))
 
 	// Cookie file should be deleted
@@ -159,7 +167,7 @@ func TestInGitUsernamePassword(t *testing.T) {
 	})
 
 	password := `$(${'"\'\"` + "`"
-	testIn(t, Source{Username: "bob", Password: password}, testInVersion, inParams{})
+	testIn(t, Source{Username: "bob", Password: password}, testInVersion, InParams{})
 	assert.Equal(t, fmt.Sprintf("username=bob\npassword=%s\n", password), string(credsOutput))
 
 	// Creds file should be deleted
@@ -168,10 +176,215 @@ func TestInGitUsernamePassword(t *testing.T) {
 }
 
 func TestInGerritVersionFile(t *testing.T) {
-	testIn(t, Source{}, testInVersion, inParams{})
+	testIn(t, Source{}, testInVersion, InParams{})
 
 	var ver Version
 	versionPath := filepath.Join(testInDestDir, gerritVersionFilename)
 	assert.NoError(t, ver.ReadFromFile(versionPath))
 	assert.True(t, testInVersion.Equal(ver), "%v != %v", testInVersion, ver)
 }
+
+func TestInGerritChangeFile(t *testing.T) {
+	testIn(t, Source{}, testInVersion, InParams{})
+
+	var snapshot map[string]interface{}
+	data, err := ioutil.ReadFile(filepath.Join(testInDestDir, gerritChangeFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &snapshot))
+	assert.Equal(t, testSubject, snapshot["subject"])
+	assert.Contains(t, snapshot, "comments")
+}
+
+func TestInGerritChangeSections(t *testing.T) {
+	testIn(t, Source{}, testInVersion, InParams{ChangeSections: &[]string{"labels"}})
+
+	var snapshot map[string]interface{}
+	data, err := ioutil.ReadFile(filepath.Join(testInDestDir, gerritChangeFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &snapshot))
+	assert.Equal(t, testSubject, snapshot["subject"])
+	assert.NotContains(t, snapshot, "comments")
+}
+
+func TestInGerritFootersFile(t *testing.T) {
+	testIn(t, Source{}, testInVersion, InParams{})
+
+	var footers Footers
+	data, err := ioutil.ReadFile(filepath.Join(testInDestDir, gerritFootersFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &footers))
+	assert.Equal(t, Footers{"Bug": {"123"}, "Change-Id": {"Itestchange"}}, footers)
+}
+
+func TestInGitFetchOptions(t *testing.T) {
+	fetchTags := false
+	testGitCalls = nil
+	testIn(t, Source{
+		Filter:       "blob:none",
+		ShallowSince: "2020-01-01",
+		SingleBranch: true,
+		FetchTags:    &fetchTags,
+	}, testInVersion, InParams{})
+
+	calls := testGitCallsIn(testInDestDir)
+	assert.Contains(t, calls, "config remote.origin.fetch +refs/heads/testbranch:refs/remotes/origin/testbranch")
+	assert.Contains(t, calls, "config remote.origin.partialclonefilter blob:none")
+	assert.Contains(t, calls, "fetch origin refs/changes/1/1/1 "+
+		"+refs/heads/testbranch:refs/remotes/origin/testbranch "+
+		"--filter=blob:none --shallow-since=2020-01-01 --no-tags")
+	assert.Contains(t, calls, "submodule update --init --recursive --filter=blob:none --single-branch")
+}
+
+func TestInGitFetchDepthAndShallowSince(t *testing.T) {
+	fetch := true
+	req := testRequest{
+		Source:  Source{Url: testGerritUrl, Fetch: &fetch, Depth: 1, ShallowSince: "2020-01-01"},
+		Version: testInVersion,
+	}
+	destDir, err := ioutil.TempDir(testTempDir, "repo")
+	assert.NoError(t, err)
+	assert.Error(t, resource.TestInFunc(t, req, nil, destDir, in))
+}
+
+const (
+	testHostKey            = "AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	testHostKeyFingerprint = "SHA256:+DiY3wvvV6TuJJhbpZisF/zLDA0zPMSvHdkr4UvCOqU"
+)
+
+func testMockSshKeyscan(t *testing.T) *[]string {
+	var keyscanArgs []string
+	execSshKeyscan = func(args ...string) ([]byte, error) {
+		keyscanArgs = args
+		hostPort := fmt.Sprintf("[%s]:%s", args[len(args)-1], args[1])
+		return []byte("# " + hostPort + " SSH-2.0-GerritCodeReview\n" +
+			hostPort + " ssh-ed25519 " + testHostKey + "\n"), nil
+	}
+	t.Cleanup(func() { execSshKeyscan = realExecSshKeyscan })
+	return &keyscanArgs
+}
+
+func testSshCommandKnownHosts(t *testing.T) (sshCommand *string, knownHosts *[]byte) {
+	sshCommand = new(string)
+	knownHosts = new([]byte)
+	mockGitWithArg("core.sshCommand", func(args []string, idx int) {
+		*sshCommand = args[idx+1]
+		const opt = "UserKnownHostsFile="
+		path := (*sshCommand)[strings.Index(*sshCommand, opt)+len(opt):]
+		path = strings.Trim(strings.Fields(path)[0], "'")
+		var err error
+		*knownHosts, err = ioutil.ReadFile(path)
+		assert.NoError(t, err)
+	})
+	return
+}
+
+func TestInGitKnownHosts(t *testing.T) {
+	sshCommand, knownHosts := testSshCommandKnownHosts(t)
+
+	hosts := "review.example.com ssh-ed25519 " + testHostKey + "\n"
+	testIn(t, Source{KnownHosts: hosts}, testInVersion, InParams{})
+	assert.Contains(t, *sshCommand, "-o StrictHostKeyChecking=yes")
+	assert.Equal(t, hosts, string(*knownHosts))
+}
+
+func TestInGitHostKeyFingerprints(t *testing.T) {
+	keyscanArgs := testMockSshKeyscan(t)
+	sshCommand, knownHosts := testSshCommandKnownHosts(t)
+
+	testIn(t, Source{
+		FetchUrl:            "ssh://review.example.com:29418/testproject",
+		HostKeyFingerprints: []string{"SHA256:other", testHostKeyFingerprint + "="},
+	}, testInVersion, InParams{})
+	assert.Equal(t, []string{"-p", "29418", "review.example.com"}, *keyscanArgs)
+	assert.Contains(t, *sshCommand, "-o StrictHostKeyChecking=yes")
+	assert.Contains(t, string(*knownHosts), "[review.example.com]:29418 ssh-ed25519 "+testHostKey+"\n")
+}
+
+func TestInGitHostKeyFingerprintMismatch(t *testing.T) {
+	testMockSshKeyscan(t)
+
+	fetch := true
+	req := testRequest{
+		Source: Source{
+			Url:                 testGerritUrl,
+			Fetch:               &fetch,
+			FetchUrl:            "ssh://review.example.com:29418/testproject",
+			HostKeyFingerprints: []string{"SHA256:other"},
+		},
+		Version: testInVersion,
+	}
+	destDir, err := ioutil.TempDir(testTempDir, "repo")
+	assert.NoError(t, err)
+	err = resource.TestInFunc(t, req, nil, destDir, in)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "offered [ssh-ed25519 "+testHostKeyFingerprint+"]")
+}
+
+func TestInGitHostKeyFingerprintsHttp(t *testing.T) {
+	fetch := true
+	req := testRequest{
+		Source: Source{
+			Url:                 testGerritUrl,
+			Fetch:               &fetch,
+			HostKeyFingerprints: []string{testHostKeyFingerprint},
+		},
+		Version: testInVersion,
+	}
+	destDir, err := ioutil.TempDir(testTempDir, "repo")
+	assert.NoError(t, err)
+	keyscanArgs := testMockSshKeyscan(t)
+	err = resource.TestInFunc(t, req, nil, destDir, in)
+	assert.NoError(t, err)
+	assert.Nil(t, *keyscanArgs)
+}
+
+func TestVerifyHostKeysTwice(t *testing.T) {
+	keyscanArgs := testMockSshKeyscan(t)
+	am := newAuthManager(Source{HostKeyFingerprints: []string{testHostKeyFingerprint}})
+	defer am.cleanup()
+
+	fetchUrl := "ssh://review.example.com:29418/testproject"
+	assert.NoError(t, am.verifyHostKeys(fetchUrl))
+	_, err := am.knownHostsPath()
+	assert.NoError(t, err)
+	*keyscanArgs = nil
+	assert.NoError(t, am.verifyHostKeys(fetchUrl))
+	assert.Nil(t, *keyscanArgs)
+
+	// Another host is scanned and added to the written known hosts.
+	assert.NoError(t, am.verifyHostKeys("ssh://other.example.com:29418/otherproject"))
+	assert.Equal(t, []string{"-p", "29418", "other.example.com"}, *keyscanArgs)
+	path, err := am.knownHostsPath()
+	assert.NoError(t, err)
+	knownHosts, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(knownHosts), "[review.example.com]:29418 ssh-ed25519 ")
+	assert.Contains(t, string(knownHosts), "[other.example.com]:29418 ssh-ed25519 ")
+}
+
+func TestInGitPrivateKey(t *testing.T) {
+	var agentSocket string
+	var agentKeys int
+	mockGitWithArg("core.sshCommand", func(args []string, idx int) {
+		const opt = "IdentityAgent="
+		sshCommand := args[idx+1]
+		agentSocket = strings.Trim(sshCommand[strings.Index(sshCommand, opt)+len(opt):], "'")
+		conn, err := net.Dial("unix", agentSocket)
+		assert.NoError(t, err)
+		defer conn.Close()
+		keys, err := agent.NewClient(conn).List()
+		assert.NoError(t, err)
+		agentKeys = len(keys)
+	})
+
+	testIn(t, Source{
+		PrivateKey:           testPrivateKey(t, ""),
+		PrivateKeys:          []string{testPrivateKey(t, "secret")},
+		PrivateKeyPassphrase: "secret",
+	}, testInVersion, InParams{})
+	assert.Equal(t, 2, agentKeys)
+
+	// Agent socket should be deleted
+	_, err := os.Stat(agentSocket)
+	assert.True(t, os.IsNotExist(err), "%s wasn't deleted", agentSocket)
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultJunitMaxFailures = 10
+	junitFailureMessageMax  = 200
+)
+
+// junitSuite is a <testsuites> or <testsuite> element.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string         `xml:"name,attr"`
+	Classname string         `xml:"classname,attr"`
+	Time      string         `xml:"time,attr"`
+	File      string         `xml:"file,attr"`
+	Line      int            `xml:"line,attr"`
+	Failures  []junitProblem `xml:"failure"`
+	Errors    []junitProblem `xml:"error"`
+	Skipped   *struct{}      `xml:"skipped"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitResults are the combined results of JUnit XML reports.
+type junitResults struct {
+	Files    int
+	Passed   int
+	Failed   int
+	Skipped  int
+	Duration time.Duration
+	Failures []junitFailure
+}
+
+type junitFailure struct {
+	Name    string
+	Message string
+	File    string
+	Line    int
+}
+
+// readJunitFiles reads the JUnit XML reports matching the glob patterns,
+// relative to dir.
+func readJunitFiles(dir string, patterns []string) (junitResults, error) {
+	var results junitResults
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return results, fmt.Errorf("invalid junit_files pattern %q: %v", pattern, err)
+		}
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return results, fmt.Errorf("error reading junit file %q: %v", path, err)
+			}
+			var suite junitSuite
+			err = xml.Unmarshal(data, &suite)
+			if err != nil {
+				return results, fmt.Errorf("error parsing junit file %q: %v", path, err)
+			}
+			results.add(suite)
+			results.Files++
+		}
+	}
+	return results, nil
+}
+
+func (r *junitResults) add(suite junitSuite) {
+	for _, s := range suite.Suites {
+		r.add(s)
+	}
+	for _, c := range suite.Cases {
+		if seconds, err := strconv.ParseFloat(c.Time, 64); err == nil {
+			r.Duration += time.Duration(seconds * float64(time.Second))
+		}
+		problems := append(c.Failures, c.Errors...)
+		switch {
+		case len(problems) > 0:
+			r.Failed++
+			name := c.Name
+			if c.Classname != "" {
+				name = c.Classname + "." + c.Name
+			}
+			r.Failures = append(r.Failures, junitFailure{
+				Name:    name,
+				Message: problems[0].summary(),
+				File:    c.File,
+				Line:    c.Line,
+			})
+		case c.Skipped != nil:
+			r.Skipped++
+		default:
+			r.Passed++
+		}
+	}
+}
+
+// summary returns the first line of the problem's message or text.
+func (p junitProblem) summary() string {
+	message := strings.TrimSpace(p.Message)
+	if message == "" {
+		message = strings.TrimSpace(p.Text)
+	}
+	if message == "" {
+		message = p.Type
+	}
+	if i := strings.Index(message, "\n"); i >= 0 {
+		message = strings.TrimSpace(message[:i])
+	}
+	if len(message) > junitFailureMessageMax {
+		message = truncateBytes(message, junitFailureMessageMax) + "..."
+	}
+	return message
+}
+
+// counts returns a one line summary of the test counts.
+func (r junitResults) counts() string {
+	return fmt.Sprintf("%d passed, %d failed, %d skipped (%s)",
+		r.Passed, r.Failed, r.Skipped, r.Duration.Round(100*time.Millisecond))
+}
+
+// summary returns the test counts followed by the first maxFailures
+// failures.
+func (r junitResults) summary(maxFailures int) string {
+	if r.Files == 0 {
+		return "No test results found."
+	}
+	lines := []string{"Tests: " + r.counts()}
+	if len(r.Failures) > 0 {
+		lines = append(lines, "", "Failures:")
+		for i, f := range r.Failures {
+			if i == maxFailures {
+				lines = append(lines, fmt.Sprintf("* ...and %d more", len(r.Failures)-maxFailures))
+				break
+			}
+			if f.Message == "" {
+				lines = append(lines, "* "+f.Name)
+			} else {
+				lines = append(lines, fmt.Sprintf("* %s: %s", f.Name, f.Message))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findings returns the failures that have a file, for inline comments.
+// Absolute paths are made relative to repoDir.
+func (r junitResults) findings(repoDir string) []finding {
+	var findings []finding
+	for _, f := range r.Failures {
+		if f.File == "" {
+			continue
+		}
+		message := f.Name + " failed"
+		if f.Message != "" {
+			message += "\n\n" + f.Message
+		}
+		findings = append(findings, finding{
+			Path:     findingPath(f.File, repoDir),
+			Line:     f.Line,
+			Message:  message,
+			Severity: "error",
+			Tool:     "junit",
+		})
+	}
+	return findings
+}
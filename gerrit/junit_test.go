@@ -0,0 +1,172 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadJunitFiles(t *testing.T) {
+	results, err := readJunitFiles("testdata", []string{"junit/*.xml", "junit/missing-*.xml"})
+	assert.NoError(t, err)
+	assert.Equal(t, junitResults{
+		Files:    2,
+		Passed:   2,
+		Failed:   2,
+		Skipped:  1,
+		Duration: 2750 * time.Millisecond,
+		Failures: []junitFailure{
+			{Name: "parser.TestParseEmpty", Message: "Failed"},
+			{
+				Name:    "tests.test_util.test_split",
+				Message: "ValueError: bad split",
+				File:    "tests/test_util.py",
+				Line:    20,
+			},
+		},
+	}, results)
+
+	assert.Equal(t, `Tests: 2 passed, 2 failed, 1 skipped (2.8s)
+
+Failures:
+* parser.TestParseEmpty: Failed
+* ...and 1 more`, results.summary(1))
+
+	assert.Equal(t, []finding{{
+		Path:     "tests/test_util.py",
+		Line:     20,
+		Message:  "tests.test_util.test_split failed\n\nValueError: bad split",
+		Severity: "error",
+		Tool:     "junit",
+	}}, results.findings(""))
+}
+
+func TestJunitProblemSummary(t *testing.T) {
+	assert.Equal(t, "first line", junitProblem{Text: "\n first line\nsecond"}.summary())
+	assert.Equal(t, "AssertionError", junitProblem{Type: "AssertionError"}.summary())
+
+	// Long messages are cut on a rune boundary.
+	long := junitProblem{Message: strings.Repeat("x", junitFailureMessageMax-1) + "é"}.summary()
+	assert.Equal(t, strings.Repeat("x", junitFailureMessageMax-1)+"...", long)
+	assert.True(t, utf8.ValidString(long))
+}
+
+func TestReadJunitFilesNone(t *testing.T) {
+	results, err := readJunitFiles("testdata", []string{"junit/*.json"})
+	assert.NoError(t, err)
+	assert.Equal(t, "No test results found.", results.summary(10))
+}
+
+// testJunitDir copies the JUnit fixtures into the out target dir.
+func testJunitDir(t *testing.T) string {
+	dir, err := ioutil.TempDir(testTempDir, "junit")
+	assert.NoError(t, err)
+	for _, name := range []string{"go.xml", "pytest.xml"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "junit", name))
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	return filepath.Base(dir)
+}
+
+func TestOutJunitFiles(t *testing.T) {
+	dir := testJunitDir(t)
+	testOut(t, Source{}, outParams{
+		Message:    "Build ${JUNIT_FAILED} failed\n\n${JUNIT_SUMMARY}\n\nDone",
+		JunitFiles: []string{dir + "/*.xml"},
+		JunitLabel: "Verified",
+		Labels:     map[string]int{"Code-Review": 1},
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, `Build 2 failed
+
+Tests: 2 passed, 2 failed, 1 skipped (2.8s)
+
+Failures:
+* parser.TestParseEmpty: Failed
+* tests.test_util.test_split: ValueError: bad split
+
+Done
+
+1 of 1 findings not commented: 1 outside the change.`, review.Message)
+	assert.Equal(t, map[string]int{"Code-Review": 1, "Verified": -1}, review.Labels)
+	// tests/test_util.py isn't in the change's files
+	assert.Empty(t, review.Comments)
+}
+
+func TestOutJunitFilesPassing(t *testing.T) {
+	dir := testJunitDir(t)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(testTempDir, dir, "pass.xml"),
+		[]byte(`<testsuite><testcase name="TestOk" time="0.1"/></testsuite>`), 0644))
+	testOut(t, Source{}, outParams{
+		Message:    "Build passed",
+		JunitFiles: []string{dir + "/pass.xml"},
+		JunitLabel: "Verified",
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, "Build passed\n\nTests: 1 passed, 0 failed, 0 skipped (100ms)", review.Message)
+	assert.Equal(t, map[string]int{"Verified": 1}, review.Labels)
+}
+
+func TestOutJunitFilesTokensInOutput(t *testing.T) {
+	os.Setenv("BUILD_ID", "7")
+	dir := testJunitDir(t)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(testTempDir, dir, "tokens.xml"),
+		[]byte(`<testsuite><testcase name="TestEnv"><failure message="${BUILD_ID} is ${JUNIT_PASSED}"/></testcase></testsuite>`), 0644))
+	testOut(t, Source{}, outParams{
+		Message:    "Build ${BUILD_ID}",
+		JunitFiles: []string{dir + "/tokens.xml"},
+	})
+	assert.Contains(t, testGerritLastReviewInput.Message, "Build 7\n\n")
+	assert.Contains(t, testGerritLastReviewInput.Message, "* TestEnv: ${BUILD_ID} is ${JUNIT_PASSED}")
+}
+
+func TestOutJunitFilesSummaryPlacement(t *testing.T) {
+	dir := testJunitDir(t)
+	summary := "Tests: 2 passed, 2 failed, 1 skipped (2.8s)"
+
+	// Mentioning JUNIT_SUMMARY isn't placing it.
+	testOut(t, Source{}, outParams{
+		Message:    "See JUNIT_SUMMARY below",
+		JunitFiles: []string{dir + "/*.xml"},
+	})
+	assert.Contains(t, testGerritLastReviewInput.Message, "See JUNIT_SUMMARY below\n\n"+summary)
+
+	testOut(t, Source{}, outParams{
+		Message:         "{{.Vars.JUNIT_SUMMARY}}\n\nDone",
+		MessageTemplate: true,
+		JunitFiles:      []string{dir + "/*.xml"},
+	})
+	assert.True(t, strings.HasPrefix(testGerritLastReviewInput.Message, summary))
+	assert.Equal(t, 1, strings.Count(testGerritLastReviewInput.Message, summary))
+}
+
+func TestOutJunitFilesMissing(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		JunitFiles: []string{"missing/*.xml"},
+		JunitLabel: "Verified",
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, "No test results found.", review.Message)
+	assert.Equal(t, map[string]int{"Verified": -1}, review.Labels)
+}
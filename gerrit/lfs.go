@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lfsPull downloads the LFS objects for the checkout in dir and all of its
+// submodules, returning the number of bytes downloaded.
+func lfsPull(dir string, params InParams, configArgs map[string]string) (int64, error) {
+	configFlags := gitConfigFlags(configArgs)
+	gitDir := filepath.Join(dir, ".git")
+	sizeBefore, err := lfsObjectsSize(gitDir)
+	if err != nil {
+		return 0, err
+	}
+
+	pullArgs := []string{"lfs", "pull"}
+	if len(params.LfsInclude) > 0 {
+		pullArgs = append(pullArgs, "--include="+strings.Join(params.LfsInclude, ","))
+	}
+	if len(params.LfsExclude) > 0 {
+		pullArgs = append(pullArgs, "--exclude="+strings.Join(params.LfsExclude, ","))
+	}
+
+	// Skip smudge so that later checkouts in the task don't need LFS auth.
+	err = git(dir, "lfs", "install", "--local", "--skip-smudge")
+	if err != nil {
+		return 0, err
+	}
+	err = git(dir, append(configFlags, pullArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	quotedPullArgs := []string{"git"}
+	for _, arg := range pullArgs {
+		quotedPullArgs = append(quotedPullArgs, shellQuote(arg))
+	}
+	err = git(dir, append(configFlags,
+		"submodule", "foreach", "--recursive",
+		"git lfs install --local --skip-smudge && "+strings.Join(quotedPullArgs, " "))...)
+	if err != nil {
+		return 0, err
+	}
+
+	sizeAfter, err := lfsObjectsSize(gitDir)
+	if err != nil {
+		return 0, err
+	}
+	return sizeAfter - sizeBefore, nil
+}
+
+// lfsObjectsSize sums the size of all LFS objects stored under gitDir,
+// including those of submodules.
+func lfsObjectsSize(gitDir string) (int64, error) {
+	lfsObjectsDir := string(filepath.Separator) + filepath.Join("lfs", "objects") +
+		string(filepath.Separator)
+	var size int64
+	err := filepath.Walk(gitDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && strings.Contains(path, lfsObjectsDir) {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func TestInLfs(t *testing.T) {
+	testGitCalls = nil
+	// An object already in the repo isn't counted as downloaded.
+	mockGitWithArg("checkout", func(args []string, idx int) {
+		objects := filepath.Join(args[1], ".git", "lfs", "objects", "00", "00")
+		assert.NoError(t, os.MkdirAll(objects, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(objects, "old"), make([]byte, 5), 0644))
+	})
+	var lfsPullConfig string
+	mockGitWithArg("pull", func(args []string, idx int) {
+		lfsPullConfig = strings.Join(args[2:idx-1], " ")
+		// Pretend to download an object into the main repo and a submodule.
+		for _, objects := range []string{
+			filepath.Join(args[1], ".git", "lfs", "objects", "ab", "cd"),
+			filepath.Join(args[1], ".git", "modules", "sub", "lfs", "objects", "ef", "01"),
+		} {
+			assert.NoError(t, os.MkdirAll(objects, 0755))
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(objects, "obj"), make([]byte, 10), 0644))
+		}
+	})
+
+	cookies := "localhost\tFALSE\t/\tFALSE\t9999999999\tauth\tbar\n"
+	_, metadata := testIn(t, Source{Cookies: cookies}, testInVersion, InParams{
+		Lfs:        true,
+		LfsInclude: []string{"*.bin", "assets/**"},
+		LfsExclude: []string{"big's/**"},
+	})
+
+	calls := testGitCallsIn(testInDestDir)
+	assert.Contains(t, calls, "lfs install --local --skip-smudge")
+	assert.Contains(t, lfsPullConfig, "-c http.cookieFile=")
+	var pull, foreach string
+	for _, call := range calls {
+		if strings.HasSuffix(call, "lfs pull --include=*.bin,assets/** --exclude=big's/**") {
+			pull = call
+		}
+		if strings.Contains(call, "submodule foreach --recursive ") {
+			foreach = call
+		}
+	}
+	assert.NotEmpty(t, pull)
+	assert.Contains(t, foreach, `git lfs install --local --skip-smudge && `+
+		`git 'lfs' 'pull' '--include=*.bin,assets/**' '--exclude=big'\''s/**'`)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "lfs bytes downloaded", Value: "20"})
+}
+
+func TestInNoLfs(t *testing.T) {
+	testGitCalls = nil
+	testIn(t, Source{}, testInVersion, InParams{})
+	for _, call := range testGitCallsIn(testInDestDir) {
+		assert.NotContains(t, call, "lfs")
+	}
+}
+
+func TestInDependsOnLfs(t *testing.T) {
+	testSetupDependsOn(t, "NEW")
+	mockGitWithArg("pull", func(args []string, idx int) {
+		objects := filepath.Join(args[1], ".git", "lfs", "objects", "ab", "cd")
+		assert.NoError(t, os.MkdirAll(objects, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(objects, "obj"), make([]byte, 10), 0644))
+	})
+
+	_, metadata := testIn(t, Source{}, testInVersion, InParams{DependsOn: true, Lfs: true})
+
+	for _, project := range []string{"libproject", "otherproject"} {
+		depDir := filepath.Join(testInDestDir, defaultDependsOnDir, project)
+		assert.Contains(t, testGitCallsIn(depDir), "lfs install --local --skip-smudge")
+	}
+	assert.Contains(t, metadata, resource.MetadataField{Name: "lfs bytes downloaded", Value: "10"})
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/google/concourse-resources/internal/resource"
 )
@@ -25,6 +26,14 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == credentialHelperArg {
+		err := runCredentialHelper(os.Args[2:], os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	log.Printf("gerrit-resource build %s", Build)
 	err := resource.RunMain()
 	if err != nil {
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -42,12 +43,19 @@ const (
 	testRevisionPrefix = "deadbeef"
 	testName           = "Testy McTestface"
 	testEmail          = "testy@example.com"
-	testCommitMessage  = "Commit message"
+	testCommitMessage  = "Commit message\n\nBug: 123\nChange-Id: Itestchange"
+	testCommentMessage = "Comment message"
 )
 
 var (
 	testTempDir string
 
+	testAccounts = []gerrit.AccountInfo{
+		{NumericID: 1000, Name: "Jane Doe", Email: "jane@example.com", Username: "jane"},
+		{NumericID: 1002, Name: "CI", Email: "ci@example.com", Username: "ci"},
+		{NumericID: 1004, Name: "CI Bot", Email: "ci-bot@example.com", Username: "ci-bot"},
+	}
+
 	testGerritUrl string
 
 	testGerritLastAuthenticated bool
@@ -56,9 +64,25 @@ var (
 	testGerritLastN             int
 	testGerritLastChangeId      string
 	testGerritLastRevision      string
-	testGerritLastReviewInput   *gerrit.ReviewInput
+	testGerritLastReviewInput   *reviewInput
+	testGerritLastHashtags      *gerrit.HashtagsInput
+	testGerritLastTopic         *string
+	testGerritLastAction        string
+	testGerritLastCheckInput    *checkInput
+	testGerritChecks            = make(map[string]bool)
+	testGerritLastActionInput   map[string]interface{}
+	testGerritActionCount       int
+	testGerritMergeable         = true
+	testGerritRevisionActions   = map[string]*gerrit.ActionInfo{
+		"submit": {Method: "POST", Label: "Submit", Enabled: true},
+	}
 
-	testGitMocks = make(map[string][]func([]string, int))
+	testGitMocks   = make(map[string][]func([]string, int))
+	testGitOutputs = make(map[string][]byte)
+	testGitCalls   [][]string
+
+	// Per-change modifications applied by testBuildChange
+	testChangeMutators = make(map[int]func(*gerrit.ChangeInfo))
 )
 
 type testRequest struct {
@@ -103,6 +127,7 @@ func TestMain(m *testing.M) {
 }
 
 func testExecGit(args ...string) ([]byte, error) {
+	testGitCalls = append(testGitCalls, args)
 	for i := 0; i < len(args); i++ {
 		mockFuncs, ok := testGitMocks[args[i]]
 		if ok {
@@ -113,13 +138,34 @@ func testExecGit(args ...string) ([]byte, error) {
 			break
 		}
 	}
+	for i := 0; i < len(args); i++ {
+		if output, ok := testGitOutputs[args[i]]; ok {
+			delete(testGitOutputs, args[i])
+			return output, nil
+		}
+	}
 	return []byte{}, nil
 }
 
+func testGitCallsIn(dir string) []string {
+	var calls []string
+	for _, args := range testGitCalls {
+		if len(args) > 2 && args[0] == "-C" && args[1] == dir {
+			calls = append(calls, strings.Join(args[2:], " "))
+		}
+	}
+	return calls
+}
+
 func mockGitWithArg(arg string, f func([]string, int)) {
 	testGitMocks[arg] = append(testGitMocks[arg], f)
 }
 
+// mockGitOutput makes the next git call with arg output output.
+func mockGitOutput(arg string, output string) {
+	testGitOutputs[arg] = []byte(output)
+}
+
 func testBuildChange(testNumber int, revisionCount int) gerrit.ChangeInfo {
 	changeId := fmt.Sprintf("%s%d", testChangeIdPrefix, testNumber)
 	change := gerrit.ChangeInfo{
@@ -166,6 +212,9 @@ func testBuildChange(testNumber int, revisionCount int) gerrit.ChangeInfo {
 		change.CurrentRevision = revision
 		change.Updated = created
 	}
+	if mutator, ok := testChangeMutators[testNumber]; ok {
+		mutator(&change)
+	}
 	return change
 }
 
@@ -196,7 +245,7 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 
-	testGerritLastAuthenticated = strings.HasPrefix(r.URL.Path, "/a")
+	testGerritLastAuthenticated = strings.HasPrefix(r.URL.Path, "/a/")
 
 	if testGerritLastAuthenticated {
 		authCookie, _ := r.Cookie("auth")
@@ -207,10 +256,26 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/a")
+	path := r.URL.Path
+	if testGerritLastAuthenticated {
+		path = strings.TrimPrefix(path, "/a")
+	}
 	pathParts := strings.Split(path, "/")
 
-	if path == "/changes/" {
+	if path == "/accounts/" {
+		testGerritLastQ = r.URL.Query().Get("q")
+		name, err := strconv.Unquote(testGerritLastQ)
+		if err != nil {
+			panic(fmt.Sprintf("unquoted account query %q", testGerritLastQ))
+		}
+		accounts := []gerrit.AccountInfo{}
+		for _, account := range testAccounts {
+			if strings.Contains(account.Email, name) || account.Username == name {
+				accounts = append(accounts, account)
+			}
+		}
+		testGerritWriteResponse(w, accounts)
+	} else if path == "/changes/" {
 		testGerritLastQ = r.URL.Query().Get("q")
 		testGerritLastN, _ = strconv.Atoi(r.URL.Query().Get("n"))
 
@@ -224,6 +289,12 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var changes []gerrit.ChangeInfo
+		if strings.HasPrefix(testGerritLastQ, "change:"+testChangeIdPrefix) {
+			testNumber, _ := strconv.Atoi(
+				strings.TrimPrefix(testGerritLastQ, "change:"+testChangeIdPrefix))
+			changes = append(changes, testBuildChange(testNumber, revisionCount))
+			n = 0
+		}
 		for i := 0; i < n; i++ {
 			changes = append(changes, testBuildChange(i+1, revisionCount))
 		}
@@ -235,17 +306,96 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 	} else if strings.HasSuffix(path, "/review") {
 		testGerritLastChangeId = pathParts[2]
 		testGerritLastRevision = pathParts[4]
+		testGerritLastReviewInput = nil
 		err = json.NewDecoder(r.Body).Decode(&testGerritLastReviewInput)
 		if err != nil {
 			panic(err)
 		}
 		// The gerrit client seems to ignore this response
 		testGerritWriteResponse(w, map[string]string{})
+	} else if strings.HasSuffix(path, "/checks/") {
+		testGerritLastChangeId = pathParts[2]
+		testGerritLastRevision = pathParts[4]
+		testGerritLastCheckInput = nil
+		err = json.NewDecoder(r.Body).Decode(&testGerritLastCheckInput)
+		if err != nil {
+			panic(err)
+		}
+		// Like the checks plugin, respond 201 for new checks.
+		key := path + testGerritLastCheckInput.CheckerUuid
+		if !testGerritChecks[key] {
+			testGerritChecks[key] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+		testGerritWriteResponse(w, testGerritLastCheckInput)
+	} else if strings.HasSuffix(path, "/hashtags") {
+		testGerritLastChangeId = pathParts[2]
+		testGerritLastHashtags = nil
+		err = json.NewDecoder(r.Body).Decode(&testGerritLastHashtags)
+		if err != nil {
+			panic(err)
+		}
+		testGerritWriteResponse(w, testGerritLastHashtags.Add)
+	} else if strings.HasSuffix(path, "/topic") {
+		if r.Method != http.MethodPut {
+			panic("unexpected topic method " + r.Method)
+		}
+		testGerritLastChangeId = pathParts[2]
+		var input struct {
+			Topic string `json:"topic"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			panic(err)
+		}
+		testGerritLastTopic = &input.Topic
+		if input.Topic == "" {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			testGerritWriteResponse(w, input.Topic)
+		}
+	} else if strings.HasSuffix(path, "/mergeable") {
+		testGerritWriteResponse(w, gerrit.MergeableInfo{Mergeable: testGerritMergeable})
+	} else if strings.HasSuffix(path, "/actions") {
+		testGerritWriteResponse(w, testGerritRevisionActions)
+	} else if action := pathParts[len(pathParts)-1]; r.Method == http.MethodPost &&
+		(action == "submit" || action == "abandon" || action == "rebase" ||
+			action == "move" || action == "cherrypick") {
+		testGerritLastChangeId = pathParts[2]
+		testGerritLastAction = action
+		testGerritLastActionInput = nil
+		err = json.NewDecoder(r.Body).Decode(&testGerritLastActionInput)
+		if err == io.EOF {
+			err = nil
+		}
+		testGerritActionCount++
+		change := testBuildChange(100+testGerritActionCount, 1)
+		if action == "submit" {
+			change.Status = "MERGED"
+		}
+		testGerritWriteResponse(w, change)
+	} else if strings.HasSuffix(path, "/files") {
+		testGerritWriteResponse(w, map[string]*gerrit.FileInfo{
+			"/COMMIT_MSG": {Status: "A"},
+			"main.go":     {LinesInserted: 10},
+			"lib/util.go": {Status: "A", LinesInserted: 20},
+		})
+	} else if strings.HasSuffix(path, "/comments") {
+		testGerritLastChangeId = pathParts[2]
+		testGerritWriteResponse(w, map[string][]gerrit.CommentInfo{
+			"main.go": {{
+				PatchSet: 1,
+				ID:       "comment1",
+				Message:  testCommentMessage,
+				Author:   &gerrit.AccountInfo{Name: testName, Email: testEmail},
+			}},
+		})
 	} else if strings.HasPrefix(path, "/changes/") {
 		testGerritLastChangeId = pathParts[2]
-		if strings.HasPrefix(testGerritLastChangeId, testChangeIdPrefix) {
-			testNumber, _ := strconv.Atoi(
-				strings.TrimPrefix(testGerritLastChangeId, testChangeIdPrefix))
+		// Accept project~branch~Change-Id triplets
+		changeId := testGerritLastChangeId[strings.LastIndex(testGerritLastChangeId, "~")+1:]
+		if strings.HasPrefix(changeId, testChangeIdPrefix) {
+			testNumber, _ := strconv.Atoi(strings.TrimPrefix(changeId, testChangeIdPrefix))
 			testGerritWriteResponse(w, testBuildChange(testNumber, revisionCount))
 		} else {
 			w.WriteHeader(http.StatusNotFound)
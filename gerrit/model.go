@@ -28,6 +28,8 @@ const (
 
 type Source struct {
 	Url                  string   `json:"url"`
+	Api                  string   `json:"api"`
+	SshUrl               string   `json:"ssh_url"`
 	Query                string   `json:"query"`
 	PatchsetVersions     string   `json:"patchset_versions"`
 	WithComment          string   `json:"with_comment"`
@@ -35,15 +37,37 @@ type Source struct {
 	Username             string   `json:"username"`
 	Password             string   `json:"password"`
 	DigestAuth           bool     `json:"digest_auth"`
+	Auth                 string   `json:"auth"`
+	OAuth2Token          string   `json:"oauth2_token"`
+	OAuth2ServiceAccount string   `json:"oauth2_service_account"`
+	OAuth2Scopes         []string `json:"oauth2_scopes"`
+	CaCert               string   `json:"ca_cert"`
+	ClientCert           string   `json:"client_cert"`
+	ClientKey            string   `json:"client_key"`
+	InsecureSkipVerify   bool     `json:"insecure_skip_verify"`
+	HttpProxy            string   `json:"http_proxy"`
+	NoProxy              string   `json:"no_proxy"`
+	RequestTimeout       string   `json:"request_timeout"`
+	MaxIdleConns         int      `json:"max_idle_conns"`
 	Fetch                *bool    `json:"fetch"`
 	FetchProtocol        string   `json:"fetch_protocol"`
 	FetchUrl             string   `json:"fetch_url"`
 	SkipSubmodules       []string `json:"skip_submodules"`
 	PrivateKey           string   `json:"private_key"`
+	PrivateKeys          []string `json:"private_keys"`
 	PrivateKeyUser       string   `json:"private_key_user"`
 	PrivateKeyPassphrase string   `json:"private_key_passphrase"`
 	Depth                int      `json:"depth"`
+	ShallowSince         string   `json:"shallow_since"`
+	Filter               string   `json:"filter"`
+	SingleBranch         bool     `json:"single_branch"`
+	FetchTags            *bool    `json:"fetch_tags"`
 	SshConfig            string   `json:"ssh_config"`
+	KnownHosts           string   `json:"known_hosts"`
+	HostKeyFingerprints  []string `json:"host_key_fingerprints"`
+	CacheDir             string   `json:"cache_dir"`
+	CacheMaxSize         int64    `json:"cache_max_size"`
+	CacheShared          bool     `json:"cache_shared"`
 }
 
 type Version struct {
@@ -0,0 +1,206 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/build/gerrit"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	// First argument to the resource binary when run as a git credential
+	// helper.
+	credentialHelperArg = "credential-helper"
+
+	defaultOAuth2TokenUrl = "https://oauth2.googleapis.com/token"
+	oauth2GitUsername     = "oauth2"
+)
+
+// serviceAccountKey is the subset of a service account JSON key needed for
+// the JWT bearer token flow.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+}
+
+func newOAuth2TokenSource(token, serviceAccount string, scopes []string) (oauth2.TokenSource, error) {
+	if token != "" && serviceAccount != "" {
+		return nil, errors.New("only one of oauth2_token and oauth2_service_account may be set")
+	}
+	if token != "" {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, TokenType: "Bearer"}), nil
+	}
+	if serviceAccount == "" {
+		return nil, errors.New("auth oauth2 requires oauth2_token or oauth2_service_account")
+	}
+
+	var key serviceAccountKey
+	err := json.Unmarshal([]byte(serviceAccount), &key)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing oauth2_service_account: %v", err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("oauth2_service_account has type %q, not \"service_account\"", key.Type)
+	}
+	if len(scopes) == 0 {
+		scopes = gerrit.OAuth2Scopes
+	}
+	config := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyId,
+		Scopes:       scopes,
+		TokenURL:     key.TokenUri,
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = defaultOAuth2TokenUrl
+	}
+	// The JWT token source fetches a new token whenever the current one
+	// expires.
+	return config.TokenSource(context.Background()), nil
+}
+
+// tokenServer hands out current OAuth2 tokens in git credential format over
+// a unix socket in a private temporary directory, so that git always gets a
+// fresh token from the credential helper.
+type tokenServer struct {
+	dir      string
+	socket   string
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+func startTokenServer(tokenSource oauth2.TokenSource) (*tokenServer, error) {
+	dir, err := ioutil.TempDir(authTempDir, "concourse-gerrit-token")
+	if err != nil {
+		return nil, err
+	}
+	ts := &tokenServer{
+		dir:    dir,
+		socket: filepath.Join(dir, "token.sock"),
+	}
+	ts.listener, err = net.Listen("unix", ts.socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error listening on token socket: %v", err)
+	}
+
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+		for {
+			conn, err := ts.listener.Accept()
+			if err != nil {
+				// The listener was closed.
+				return
+			}
+			ts.serve(conn, tokenSource)
+		}
+	}()
+	return ts, nil
+}
+
+func (ts *tokenServer) serve(conn net.Conn, tokenSource oauth2.TokenSource) {
+	defer conn.Close()
+	token, err := tokenSource.Token()
+	if err != nil {
+		log.Printf("error getting oauth2 token: %v", err)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "%s\n", token.AccessToken)
+	if err != nil {
+		log.Printf("error sending oauth2 token: %v", err)
+	}
+}
+
+func (ts *tokenServer) close() {
+	ts.listener.Close()
+	ts.wg.Wait()
+	err := os.RemoveAll(ts.dir)
+	if err != nil {
+		log.Printf("error removing token dir %q: %s", ts.dir, err)
+	}
+}
+
+// credentialHelperCommand returns a credential.helper value that runs this
+// binary as a git credential helper backed by the token server.
+func (ts *tokenServer) credentialHelperCommand() (string, error) {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("!%s %s %s",
+		shellQuote(executablePath), credentialHelperArg, shellQuote(ts.socket)), nil
+}
+
+// runCredentialHelper implements the git credential helper protocol, see
+// https://git-scm.com/docs/gitcredentials#_custom_helpers
+// args are the token socket and the helper action.
+func runCredentialHelper(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <socket> <action>", credentialHelperArg)
+	}
+	socket, action := args[0], args[1]
+	if action != "get" {
+		// Nothing to store or erase.
+		return nil
+	}
+
+	// Bearer tokens can only be given to git versions that ask for them.
+	bearer := false
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		if scanner.Text() == "capability[]=authtype" {
+			bearer = true
+		}
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	token, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading token: %v", err)
+	}
+	token = strings.TrimSpace(token)
+
+	if bearer {
+		_, err = fmt.Fprintf(stdout,
+			"capability[]=authtype\nauthtype=Bearer\ncredential=%s\n", token)
+	} else {
+		_, err = fmt.Fprintf(stdout, "username=%s\npassword=%s\n", oauth2GitUsername, token)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokenServer is a fake OAuth2 token endpoint issuing tokens that expire
+// immediately, so every use needs a new one.
+func testTokenServer(t *testing.T) (*httptest.Server, *int) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+		assert.NotEmpty(t, r.Form.Get("assertion"))
+		count++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token%d", count),
+			"token_type":   "Bearer",
+			"expires_in":   1,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func testServiceAccount(t *testing.T, tokenUri string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	data, err := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "ci@example.iam.gserviceaccount.com",
+		PrivateKeyId: "keyid",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenUri:     tokenUri,
+	})
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestCheckSourceOAuth2Token(t *testing.T) {
+	testCheck(t, Source{Auth: "oauth2", OAuth2Token: "static"}, Version{})
+	assert.True(t, testGerritLastAuthenticated)
+	assert.Equal(t, "Bearer static", testGerritLastRequest.Header.Get("authorization"))
+}
+
+func TestOutOAuth2Token(t *testing.T) {
+	testOut(t, Source{Auth: "oauth2", OAuth2Token: "static"}, outParams{Message: "foo bar"})
+	assert.Equal(t, "foo bar", testGerritLastReviewInput.Message)
+	assert.Equal(t, "/a/changes/outChange/revisions/outRev/review", testGerritLastRequest.URL.Path)
+	assert.Equal(t, "Bearer static", testGerritLastRequest.Header.Get("authorization"))
+}
+
+func TestCheckSourceOAuth2ServiceAccount(t *testing.T) {
+	tokenServer, count := testTokenServer(t)
+	testCheck(t, Source{
+		Auth:                 "oauth2",
+		OAuth2ServiceAccount: testServiceAccount(t, tokenServer.URL),
+	}, Version{})
+	assert.True(t, testGerritLastAuthenticated)
+	assert.Equal(t, fmt.Sprintf("Bearer token%d", *count),
+		testGerritLastRequest.Header.Get("authorization"))
+}
+
+func TestOAuth2CredentialHelper(t *testing.T) {
+	tokenServer, _ := testTokenServer(t)
+	am := newAuthManager(Source{
+		Auth:                 "oauth2",
+		OAuth2ServiceAccount: testServiceAccount(t, tokenServer.URL),
+	})
+	defer am.cleanup()
+
+	configArgs, err := am.gitConfigArgs()
+	assert.NoError(t, err)
+	assert.Contains(t, configArgs["credential.helper"], credentialHelperArg)
+	socket := am.tokenServer.socket
+
+	// Each request gets a fresh token.
+	var out bytes.Buffer
+	input := "protocol=https\nhost=review.example.com\n\n"
+	assert.NoError(t, runCredentialHelper(
+		[]string{socket, "get"}, strings.NewReader(input), &out))
+	assert.Equal(t, "username=oauth2\npassword=token1\n", out.String())
+
+	out.Reset()
+	input = "capability[]=authtype\nprotocol=https\nhost=review.example.com\n\n"
+	assert.NoError(t, runCredentialHelper(
+		[]string{socket, "get"}, strings.NewReader(input), &out))
+	assert.Equal(t, "capability[]=authtype\nauthtype=Bearer\ncredential=token2\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, runCredentialHelper(
+		[]string{socket, "store"}, strings.NewReader(input), &out))
+	assert.Empty(t, out.String())
+}
+
+func TestOAuth2MissingCredentials(t *testing.T) {
+	_, err := newAuthManager(Source{Auth: "oauth2"}).gerritAuth()
+	assert.Error(t, err)
+}
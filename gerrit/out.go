@@ -16,24 +16,115 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"golang.org/x/build/gerrit"
+	"gopkg.in/yaml.v3"
 
 	"github.com/google/concourse-resources/internal/resource"
 )
 
+const (
+	ifOutdatedPost        = "post"
+	ifOutdatedSkip        = "skip"
+	ifOutdatedCommentOnly = "comment_only"
+	ifOutdatedFail        = "fail"
+)
+
 type outParams struct {
-	Repository  string         `json:"repository"`
-	Message     string         `json:"message"`
-	MessageFile string         `json:"message_file"`
-	Labels      map[string]int `json:"labels"`
+	Repository       string         `json:"repository"`
+	Message          string         `json:"message"`
+	MessageFile      string         `json:"message_file"`
+	Labels           map[string]int `json:"labels"`
+	CommentsFile     string         `json:"comments_file"`
+	CommentsFormat   string         `json:"comments_format"`
+	RobotComments    bool           `json:"robot_comments"`
+	RobotId          string         `json:"robot_id"`
+	OnlyChangedLines bool           `json:"only_changed_lines"`
+	MaxComments      int            `json:"max_comments"`
+	JunitFiles       []string       `json:"junit_files"`
+	JunitLabel       string         `json:"junit_label"`
+	JunitMaxFailures int            `json:"junit_max_failures"`
+	LabelsFile       string         `json:"labels_file"`
+
+	MessageTemplate  bool              `json:"message_template"`
+	TemplateData     map[string]string `json:"template_data"`
+	MaxMessageLength int               `json:"max_message_length"`
+
+	Tag                    string                `json:"tag"`
+	Notify                 string                `json:"notify"`
+	NotifyDetails          map[string]notifyInfo `json:"notify_details"`
+	OmitDuplicateComments  bool                  `json:"omit_duplicate_comments"`
+	AddToAttentionSet      []string              `json:"add_to_attention_set"`
+	RemoveFromAttentionSet []string              `json:"remove_from_attention_set"`
+	AttentionSetReason     string                `json:"attention_set_reason"`
+	RemoveOwnAttention     bool                  `json:"remove_own_attention"`
+
+	Reviewers     []string `json:"reviewers"`
+	Ccs           []string `json:"ccs"`
+	ReviewersFile string   `json:"reviewers_file"`
+
+	AddHashtags    []string `json:"add_hashtags"`
+	RemoveHashtags []string `json:"remove_hashtags"`
+	// Topic is a pointer so an empty topic can clear it.
+	Topic *string `json:"topic"`
+
+	Upload  bool   `json:"upload"`
+	Project string `json:"project"`
+	Branch  string `json:"branch"`
+	Wip     bool   `json:"wip"`
+	Private bool   `json:"private"`
+
+	Change      string `json:"change"`
+	PatchSet    int    `json:"patch_set"`
+	Revision    string `json:"revision"`
+	VersionFile string `json:"version_file"`
+
+	CheckerUuid string `json:"checker_uuid"`
+	CheckState  string `json:"check_state"`
+
+	IfOutdated string `json:"if_outdated"`
+	Idempotent bool   `json:"idempotent"`
+
+	Action             string   `json:"action"`
+	AbandonMessage     string   `json:"abandon_message"`
+	RebaseBase         string   `json:"rebase_base"`
+	AllowConflicts     bool     `json:"allow_conflicts"`
+	MoveBranch         string   `json:"move_branch"`
+	CherryPickBranches []string `json:"cherry_pick_branches"`
+}
+
+// labelsFile is a labels_file written by a task, merged over the static
+// params.
+type labelsFile struct {
+	Labels        map[string]int        `yaml:"labels"`
+	Message       string                `yaml:"message"`
+	Notify        string                `yaml:"notify"`
+	NotifyDetails map[string]notifyInfo `yaml:"notify_details"`
+}
+
+// readLabelsFile reads a JSON or YAML labels_file.
+func readLabelsFile(path string) (*labelsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading labels file %q: %v", path, err)
+	}
+	var lf labelsFile
+	// JSON is valid YAML
+	err = yaml.Unmarshal(data, &lf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing labels file %q: %v", path, err)
+	}
+	return &lf, nil
 }
 
 func init() {
@@ -48,6 +139,24 @@ func out(req resource.OutRequest) error {
 		return err
 	}
 
+	err = validateAction(src, params)
+	if err != nil {
+		return err
+	}
+	err = validateCheck(src, params)
+	if err != nil {
+		return err
+	}
+	if params.Idempotent && src.Api == "ssh" {
+		return errors.New("idempotent is not supported by api \"ssh\"")
+	}
+	switch params.IfOutdated {
+	case "", ifOutdatedPost, ifOutdatedSkip, ifOutdatedCommentOnly, ifOutdatedFail:
+	default:
+		return fmt.Errorf(
+			"invalid if_outdated %q: want post, skip, comment_only or fail", params.IfOutdated)
+	}
+
 	err = src.WriteSshConfig()
 	if err != nil {
 		return err
@@ -56,16 +165,20 @@ func out(req resource.OutRequest) error {
 	authMan := newAuthManager(src)
 	defer authMan.cleanup()
 
-	// Read gerrit_version.json
-	var ver Version
-	if params.Repository == "" {
-		return errors.New("param repository required")
+	if params.Upload {
+		return upload(req, src, authMan, params)
 	}
-	gerritVersionPath := filepath.Join(
-		req.TargetDir(), params.Repository, gerritVersionFilename)
-	err = ver.ReadFromFile(gerritVersionPath)
+
+	c, err := gerritApiClient(src, authMan)
 	if err != nil {
-		return fmt.Errorf("error reading %q: %v", gerritVersionPath, err)
+		return fmt.Errorf("error setting up gerrit client: %v", err)
+	}
+
+	ctx := context.Background()
+
+	ver, err := outVersion(req, c, ctx, params)
+	if err != nil {
+		return err
 	}
 	req.SetResponseVersion(ver)
 
@@ -87,7 +200,340 @@ func out(req resource.OutRequest) error {
 		}
 	}
 
-	buildUrl := fmt.Sprintf(
+	var labelsFromFile *labelsFile
+	if params.LabelsFile != "" {
+		labelsFromFile, err = readLabelsFile(filepath.Join(req.TargetDir(), params.LabelsFile))
+		if err != nil {
+			return err
+		}
+		if labelsFromFile.Message != "" {
+			message = labelsFromFile.Message
+		}
+	}
+
+	labels := make(map[string]int)
+	for label, value := range params.Labels {
+		labels[label] = value
+	}
+	var findings []finding
+	// JUnit tokens in the order they're replaced, as token, value pairs.
+	var junitTokens []string
+	if len(params.JunitFiles) > 0 {
+		results, err := readJunitFiles(req.TargetDir(), params.JunitFiles)
+		if err != nil {
+			return err
+		}
+		maxFailures := params.JunitMaxFailures
+		if maxFailures <= 0 {
+			maxFailures = defaultJunitMaxFailures
+		}
+		junitTokens = []string{
+			"${JUNIT_SUMMARY}", results.summary(maxFailures),
+			"${JUNIT_PASSED}", strconv.Itoa(results.Passed),
+			"${JUNIT_FAILED}", strconv.Itoa(results.Failed),
+			"${JUNIT_SKIPPED}", strconv.Itoa(results.Skipped),
+		}
+		if !strings.Contains(message, "${JUNIT_SUMMARY}") &&
+			!(params.MessageTemplate && strings.Contains(message, ".Vars.JUNIT_SUMMARY")) {
+			message = strings.TrimSpace(message + "\n\n${JUNIT_SUMMARY}")
+		}
+		if params.JunitLabel != "" {
+			if results.Files > 0 && results.Failed == 0 {
+				labels[params.JunitLabel] = 1
+			} else {
+				labels[params.JunitLabel] = -1
+			}
+		}
+		findings = results.findings(filepath.Join(req.TargetDir(), params.Repository))
+		req.AddResponseMetadata("tests", results.counts())
+	}
+	if labelsFromFile != nil {
+		for label, value := range labelsFromFile.Labels {
+			labels[label] = value
+		}
+	}
+
+	buildUrl := buildUrl()
+	// Replace environment variables in message
+	variableTokens := buildVariableTokens()
+
+	if params.MessageTemplate {
+		vars := make(map[string]string)
+		for k, v := range variableTokens {
+			vars[k] = v
+		}
+		for i := 0; i < len(junitTokens); i += 2 {
+			vars[junitTokens[i]] = junitTokens[i+1]
+		}
+		dataFiles := make(map[string]string)
+		for name, path := range params.TemplateData {
+			dataFiles[name] = filepath.Join(req.TargetDir(), path)
+		}
+		data, err := newMessageData(c, ctx, ver, vars, dataFiles)
+		if err != nil {
+			return err
+		}
+		// Variables are rendered by the template rather than substituted, so
+		// ${...} in the rendered change data is left alone.
+		message, err = renderMessage(varActions(vars).Replace(message), data)
+		if err != nil {
+			return err
+		}
+	} else {
+		for k, v := range variableTokens {
+			message = strings.Replace(message, k, v, -1)
+		}
+		// JUnit tokens go last and in one pass, so test output in their
+		// values is never substituted.
+		message = strings.NewReplacer(junitTokens...).Replace(message)
+	}
+
+	// Send review
+	if params.IfOutdated != "" {
+		current, err := currentRevision(c, ctx, ver.ChangeId)
+		if err != nil {
+			return err
+		}
+		outdated := current != ver.Revision
+		if !outdated {
+			req.AddResponseMetadata("outdated", "no")
+		} else {
+			log.Printf("revision %q is outdated; current revision is %q", ver.Revision, current)
+			switch params.IfOutdated {
+			case ifOutdatedPost:
+				req.AddResponseMetadata("outdated", "posted")
+			case ifOutdatedSkip:
+				req.AddResponseMetadata("outdated", "skipped")
+				return nil
+			case ifOutdatedCommentOnly:
+				req.AddResponseMetadata("outdated", "posted without votes")
+				labels = nil
+			case ifOutdatedFail:
+				return fmt.Errorf(
+					"revision %q is outdated; current revision is %q", ver.Revision, current)
+			}
+		}
+	}
+
+	if params.CheckerUuid != "" {
+		// checker_uuid is validated above to be used with the REST api.
+		err = postCheck(req, c.(checksApi), ctx, params, ver, message, buildUrl)
+		if err != nil {
+			return err
+		}
+	} else {
+		review, err := newReviewInput(params, labelsFromFile, message, labels, buildUrl)
+		if err != nil {
+			return err
+		}
+		posted := false
+		if params.Idempotent {
+			review.Tag += ":" + idempotencyKey(params, ver)
+			posted, err = reviewPosted(c, ctx, ver.ChangeId, review.Tag)
+			if err != nil {
+				return err
+			}
+		}
+		if posted {
+			log.Printf("review tagged %q already posted; not posting again", review.Tag)
+			req.AddResponseMetadata("review", "already posted")
+		} else {
+			err = sendReview(req, c, ctx, params, ver, buildUrl, findings, review)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(params.AddHashtags) > 0 || len(params.RemoveHashtags) > 0 {
+		hashtags, err := c.SetHashtags(ctx, ver.ChangeId, gerrit.HashtagsInput{
+			Add:    params.AddHashtags,
+			Remove: params.RemoveHashtags,
+		})
+		if err != nil {
+			return fmt.Errorf("error setting hashtags: %v", err)
+		}
+		if hashtags != nil {
+			req.AddResponseMetadata("hashtags", strings.Join(hashtags, ", "))
+		}
+	}
+	if params.Topic != nil {
+		err = c.SetTopic(ctx, ver.ChangeId, *params.Topic)
+		if err != nil {
+			return fmt.Errorf("error setting topic: %v", err)
+		}
+		req.AddResponseMetadata("topic", *params.Topic)
+	}
+
+	return runAction(req, src, c, ctx, params, ver)
+}
+
+// outVersion returns the version to review: read from the repository's
+// gerrit_version.json or version_file, or looked up from change.
+func outVersion(req resource.OutRequest, c gerritApi, ctx context.Context, params outParams) (Version, error) {
+	var ver Version
+	targets := 0
+	for _, target := range []string{params.Repository, params.VersionFile, params.Change} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return ver, errors.New("only one of params repository, version_file and change can be set")
+	}
+	if params.Revision != "" && params.PatchSet > 0 {
+		return ver, errors.New("params revision and patch_set can't be used together")
+	}
+	if (params.Revision != "" || params.PatchSet > 0) && params.Change == "" {
+		return ver, errors.New("params revision and patch_set require param change")
+	}
+
+	var versionPath string
+	switch {
+	case params.Repository != "":
+		versionPath = filepath.Join(req.TargetDir(), params.Repository, gerritVersionFilename)
+	case params.VersionFile != "":
+		versionPath = filepath.Join(req.TargetDir(), params.VersionFile)
+	case params.Change != "":
+		change, err := c.GetChange(ctx, params.Change,
+			gerrit.QueryChangesOpt{Fields: []string{"ALL_REVISIONS"}})
+		if err != nil {
+			return ver, fmt.Errorf("error getting change %q: %v", params.Change, err)
+		}
+		revision := params.Revision
+		if params.PatchSet > 0 {
+			for rev, info := range change.Revisions {
+				if info.PatchSetNumber == params.PatchSet {
+					revision = rev
+				}
+			}
+			if revision == "" {
+				return ver, fmt.Errorf("no patch set %d on change %q", params.PatchSet, params.Change)
+			}
+		} else if revision == "" {
+			revision = change.CurrentRevision
+		}
+		rev, ok := change.Revisions[revision]
+		if !ok {
+			return ver, fmt.Errorf("no revision %q on change %q", revision, params.Change)
+		}
+		return Version{
+			ChangeId: change.ID,
+			Revision: revision,
+			Created:  rev.Created.Time(),
+		}, nil
+	default:
+		return ver, errors.New("param repository, version_file or change required")
+	}
+	err := ver.ReadFromFile(versionPath)
+	if err != nil {
+		return ver, fmt.Errorf("error reading %q: %v", versionPath, err)
+	}
+	return ver, nil
+}
+
+// sendReview adds reviewers and comments to review and posts it.
+func sendReview(
+	req resource.OutRequest,
+	c gerritApi,
+	ctx context.Context,
+	params outParams,
+	ver Version,
+	buildUrl string,
+	findings []finding,
+	review reviewInput,
+) error {
+	reviewers, ccs := params.Reviewers, params.Ccs
+	if params.ReviewersFile != "" {
+		rf, err := readReviewersFile(filepath.Join(req.TargetDir(), params.ReviewersFile))
+		if err != nil {
+			return err
+		}
+		reviewers = append(append([]string{}, reviewers...), rf.Reviewers...)
+		ccs = append(append([]string{}, ccs...), rf.Ccs...)
+	}
+	addedReviewers, err := addReviewers(c, ctx, reviewers, ccs, &review)
+	if err != nil {
+		return err
+	}
+	if params.CommentsFile != "" {
+		fileFindings, err := readFindings(
+			filepath.Join(req.TargetDir(), params.CommentsFile), params.CommentsFormat,
+			filepath.Join(req.TargetDir(), params.Repository))
+		if err != nil {
+			return err
+		}
+		findings = append(fileFindings, findings...)
+	}
+	if len(findings) > 0 {
+		err = addFindingComments(req, c, ctx, params, ver, buildUrl, findings, &review)
+		if err != nil {
+			return err
+		}
+	}
+
+	review.Message = truncateMessage(review.Message, maxMessageLength(params))
+
+	err = c.SetReview(ctx, ver.ChangeId, ver.Revision, review)
+	if err != nil {
+		return fmt.Errorf("error sending review: %v", err)
+	}
+	for _, added := range addedReviewers {
+		req.AddResponseMetadata(added[0], added[1])
+	}
+	return nil
+}
+
+// idempotencyKey identifies a put of params on ver within a build, so
+// retries of the put get the same key.
+func idempotencyKey(params outParams, ver Version) string {
+	hash := sha256.New()
+	for _, name := range []string{
+		"ATC_EXTERNAL_URL",
+		"BUILD_TEAM_NAME",
+		"BUILD_PIPELINE_NAME",
+		"BUILD_JOB_NAME",
+		"BUILD_NAME",
+		"BUILD_ID",
+	} {
+		fmt.Fprintf(hash, "%s=%s\n", name, os.Getenv(name))
+	}
+	// The repository is just where the version was read from.
+	params.Repository = ""
+	// Encoding is deterministic; maps are encoded with sorted keys.
+	json.NewEncoder(hash).Encode(ver)
+	json.NewEncoder(hash).Encode(params)
+	return fmt.Sprintf("%x", hash.Sum(nil))[:16]
+}
+
+// reviewPosted returns whether a message tagged tag is on the change.
+func reviewPosted(c gerritApi, ctx context.Context, changeId string, tag string) (bool, error) {
+	change, err := c.GetChange(ctx, changeId,
+		gerrit.QueryChangesOpt{Fields: []string{"MESSAGES"}})
+	if err != nil {
+		return false, fmt.Errorf("error getting change %q: %v", changeId, err)
+	}
+	for _, message := range change.Messages {
+		if message.Tag == tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// currentRevision returns the current revision of the change.
+func currentRevision(c gerritApi, ctx context.Context, changeId string) (string, error) {
+	change, err := c.GetChange(ctx, changeId,
+		gerrit.QueryChangesOpt{Fields: []string{"CURRENT_REVISION"}})
+	if err != nil {
+		return "", fmt.Errorf("error getting change %q: %v", changeId, err)
+	}
+	return change.CurrentRevision, nil
+}
+
+// buildUrl returns the link to the running build.
+func buildUrl() string {
+	return fmt.Sprintf(
 		"%v/teams/%v/pipelines/%v/jobs/%v/builds/%v",
 		os.Getenv("ATC_EXTERNAL_URL"),
 		os.Getenv("BUILD_TEAM_NAME"),
@@ -95,36 +541,62 @@ func out(req resource.OutRequest) error {
 		os.Getenv("BUILD_JOB_NAME"),
 		os.Getenv("BUILD_NAME"),
 	)
-	// Replace environment variables in message
-	var variableTokens = map[string]string{
+}
+
+// buildVariableTokens returns the build metadata tokens replaced in messages.
+func buildVariableTokens() map[string]string {
+	return map[string]string{
 		"${BUILD_ID}":            os.Getenv("BUILD_ID"),
 		"${BUILD_NAME}":          os.Getenv("BUILD_NAME"),
 		"${BUILD_JOB_NAME}":      os.Getenv("BUILD_JOB_NAME"),
 		"${BUILD_PIPELINE_NAME}": os.Getenv("BUILD_PIPELINE_NAME"),
 		"${BUILD_TEAM_NAME}":     os.Getenv("BUILD_TEAM_NAME"),
 		"${ATC_EXTERNAL_URL}":    os.Getenv("ATC_EXTERNAL_URL"),
-		"${BUILD_URL}":           buildUrl,
-	}
-
-	for k, v := range variableTokens {
-		message = strings.Replace(message, k, v, -1)
+		"${BUILD_URL}":           buildUrl(),
 	}
+}
 
-	// Send review
-	c, err := gerritClient(src, authMan)
+// addFindingComments adds findings to review as inline comments.
+func addFindingComments(
+	req resource.OutRequest,
+	c gerritApi,
+	ctx context.Context,
+	params outParams,
+	ver Version,
+	buildUrl string,
+	findings []finding,
+	review *reviewInput,
+) error {
+	repoDir := filepath.Join(req.TargetDir(), params.Repository)
+	files, err := c.ListFiles(ctx, ver.ChangeId, ver.Revision)
 	if err != nil {
-		return fmt.Errorf("error setting up gerrit client: %v", err)
+		return fmt.Errorf("error listing files of %q: %v", ver.ChangeId, err)
 	}
-
-	ctx := context.Background()
-
-	err = c.SetReview(ctx, ver.ChangeId, ver.Revision, gerrit.ReviewInput{
-		Message: message,
-		Labels:  params.Labels,
-	})
-	if err != nil {
-		return fmt.Errorf("error sending review: %v", err)
+	fc := findingComments{
+		files:       make(map[string]bool),
+		maxComments: params.MaxComments,
+		robot:       params.RobotComments,
+		robotId:     params.RobotId,
+		robotRunId:  os.Getenv("BUILD_ID"),
+		url:         buildUrl,
+	}
+	for file := range files {
+		fc.files[file] = true
+	}
+	if fc.maxComments <= 0 {
+		fc.maxComments = defaultMaxComments
+	}
+	if params.OnlyChangedLines {
+		fc.changedLines, err = readChangedLines(repoDir)
+		if err != nil {
+			return fmt.Errorf("only_changed_lines requires a fetched repository: %v", err)
+		}
 	}
 
+	summary := fc.addTo(review, findings)
+	if summary != "" {
+		review.Message = strings.TrimSpace(review.Message + "\n\n" + summary)
+	}
+	req.AddResponseMetadata("comments posted", strconv.Itoa(fc.posted))
 	return nil
 }
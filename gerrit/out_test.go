@@ -15,12 +15,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/build/gerrit"
 
 	"github.com/google/concourse-resources/internal/resource"
 )
@@ -32,25 +35,43 @@ var (
 	}
 )
 
-func testOut(t *testing.T, src Source, params outParams) Version {
-	src.Url = testGerritUrl
-
-	repoDir, err := ioutil.TempDir(testTempDir, "repo")
-	if err != nil {
-		panic(err)
-	}
-
-	err = testOutVersion.WriteToFile(filepath.Join(repoDir, gerritVersionFilename))
-	if err != nil {
-		panic(err)
+// testOutAt runs out on ver, decoding the response into resp unless it's
+// nil. A zero ver runs out without a repository.
+func testOutAt(t *testing.T, src Source, ver Version, params outParams, resp *testResourceResponse) error {
+	if ver != (Version{}) {
+		repoDir, err := ioutil.TempDir(testTempDir, "repo")
+		if err != nil {
+			panic(err)
+		}
+		err = ver.WriteToFile(filepath.Join(repoDir, gerritVersionFilename))
+		if err != nil {
+			panic(err)
+		}
+		params.Repository = filepath.Base(repoDir)
 	}
-	params.Repository = filepath.Base(repoDir)
 
 	src.Url = testGerritUrl
 	req := testRequest{Source: src, Params: params}
+	if resp == nil {
+		return resource.TestOutFunc(t, req, nil, testTempDir, out)
+	}
+	return resource.TestOutFunc(t, req, resp, testTempDir, out)
+}
+
+func testOut(t *testing.T, src Source, params outParams) (Version, []resource.MetadataField) {
 	var resp testResourceResponse
-	assert.NoError(t, resource.TestOutFunc(t, req, &resp, testTempDir, out))
-	return resp.Version
+	assert.NoError(t, testOutAt(t, src, testOutVersion, params, &resp))
+	return resp.Version, resp.Metadata
+}
+
+// testOutError runs out with params, expecting it to fail.
+func testOutError(t *testing.T, src Source, params outParams) error {
+	err := testOutAt(t, src, testOutVersion, params, nil)
+	assert.Error(t, err)
+	if err == nil {
+		return errors.New("no error")
+	}
+	return err
 }
 
 func TestOutVersion(t *testing.T) {
@@ -64,6 +85,32 @@ func TestOutMessage(t *testing.T) {
 	assert.Equal(t, "foo bar", testGerritLastReviewInput.Message)
 }
 
+func TestOutCookies(t *testing.T) {
+	cookies := "localhost\tFALSE\t/\tFALSE\t9999999999\tauth\tbar\n"
+	testOut(t, Source{Cookies: cookies}, outParams{Message: "foo bar"})
+	assert.Equal(t, "foo bar", testGerritLastReviewInput.Message)
+	assert.Equal(t, "/a/changes/outChange/revisions/outRev/review", testGerritLastRequest.URL.Path)
+	cookie, err := testGerritLastRequest.Cookie("auth")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", cookie.Value)
+}
+
+func TestOutUsernamePassword(t *testing.T) {
+	testOut(t, Source{Username: "bob", Password: "dog"}, outParams{Message: "foo bar"})
+	assert.Equal(t, "foo bar", testGerritLastReviewInput.Message)
+	assert.Equal(t, "/a/changes/outChange/revisions/outRev/review", testGerritLastRequest.URL.Path)
+	authHeader := testGerritLastRequest.Header.Get("authorization")
+	assert.Equal(t, "Basic Ym9iOmRvZw==", authHeader) // == Base64("bob:dog")
+}
+
+func TestOutDigestAuth(t *testing.T) {
+	testOut(t, Source{Username: "bob", Password: "dog", DigestAuth: true}, outParams{Message: "foo bar"})
+	assert.Equal(t, "foo bar", testGerritLastReviewInput.Message)
+	assert.Equal(t, "/a/changes/outChange/revisions/outRev/review", testGerritLastRequest.URL.Path)
+	authHeader := testGerritLastRequest.Header.Get("authorization")
+	assert.Contains(t, authHeader, `Digest username="bob", realm="Gerrit", nonce="foobar"`)
+}
+
 func TestOutMessageWithBuildId(t *testing.T) {
 	// Test Data
 	environmentValue := "1"
@@ -176,3 +223,397 @@ func TestOutLabels(t *testing.T) {
 	assert.Equal(t, 1, testGerritLastReviewInput.Labels["Code-Review"])
 	assert.Equal(t, -1, testGerritLastReviewInput.Labels["Verified"])
 }
+
+func TestOutLabelsFileJson(t *testing.T) {
+	err := ioutil.WriteFile(
+		filepath.Join(testTempDir, "labels.json"),
+		[]byte(`{"labels": {"Verified": 1}, "message": "Build ${BUILD_ID} passed", "notify": "OWNER"}`), 0600)
+	assert.NoError(t, err)
+
+	os.Setenv("BUILD_ID", "1")
+	testOut(t, Source{}, outParams{
+		Message:    "static msg",
+		Labels:     map[string]int{"Code-Review": 1, "Verified": -1},
+		LabelsFile: "labels.json",
+	})
+	assert.Equal(t, "Build 1 passed", testGerritLastReviewInput.Message)
+	assert.Equal(t, map[string]int{"Code-Review": 1, "Verified": 1}, testGerritLastReviewInput.Labels)
+	assert.Equal(t, "OWNER", testGerritLastReviewInput.Notify)
+}
+
+func TestOutLabelsFileYaml(t *testing.T) {
+	err := ioutil.WriteFile(
+		filepath.Join(testTempDir, "labels.yaml"),
+		[]byte("labels:\n  Verified: -1\nnotify: NONE\nnotify_details:\n  TO:\n    accounts: [jane@example.com]\n"), 0600)
+	assert.NoError(t, err)
+
+	testOut(t, Source{}, outParams{Message: "static msg", LabelsFile: "labels.yaml"})
+	assert.Equal(t, "static msg", testGerritLastReviewInput.Message)
+	assert.Equal(t, map[string]int{"Verified": -1}, testGerritLastReviewInput.Labels)
+	assert.Equal(t, "NONE", testGerritLastReviewInput.Notify)
+	assert.Equal(t, map[string]notifyInfo{"TO": {Accounts: []string{"jane@example.com"}}},
+		testGerritLastReviewInput.NotifyDetails)
+}
+
+func TestOutLabelsFileMissing(t *testing.T) {
+	err := testOutError(t, Source{}, outParams{LabelsFile: "missing.json"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error reading labels file")
+}
+
+func TestOutTag(t *testing.T) {
+	testOut(t, Source{}, outParams{})
+	assert.Equal(t, "autogenerated:concourse", testGerritLastReviewInput.Tag)
+
+	testOut(t, Source{}, outParams{Tag: "autogenerated:ci:lint"})
+	assert.Equal(t, "autogenerated:ci:lint", testGerritLastReviewInput.Tag)
+}
+
+func TestOutReviewOptions(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		Notify:                 "OWNER_REVIEWERS",
+		NotifyDetails:          map[string]notifyInfo{"CC": {Accounts: []string{"1000"}}},
+		OmitDuplicateComments:  true,
+		AddToAttentionSet:      []string{"jane@example.com"},
+		RemoveFromAttentionSet: []string{"ci@example.com", "self"},
+		AttentionSetReason:     "Build failed",
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, "OWNER_REVIEWERS", review.Notify)
+	assert.Equal(t, map[string]notifyInfo{"CC": {Accounts: []string{"1000"}}}, review.NotifyDetails)
+	assert.True(t, review.OmitDuplicateComments)
+	assert.Equal(t, []attentionSetInput{{"jane@example.com", "Build failed"}}, review.AddToAttentionSet)
+	assert.Equal(t, []attentionSetInput{
+		{"ci@example.com", "Build failed"},
+		{"self", "Build failed"},
+	}, review.RemoveFromAttentionSet)
+}
+
+func TestOutInvalidNotify(t *testing.T) {
+	err := testOutError(t, Source{}, outParams{Notify: "EVERYONE"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid notify "EVERYONE"`)
+}
+
+func TestOutReviewers(t *testing.T) {
+	_, metadata := testOut(t, Source{}, outParams{
+		Reviewers:          []string{"jane", "1001", "ci"},
+		Ccs:                []string{"Core Team"},
+		RemoveOwnAttention: true,
+	})
+	review := testGerritLastReviewInput
+	assert.Equal(t, []gerrit.ReviewerInput{
+		{Reviewer: "1000", State: "REVIEWER"},
+		{Reviewer: "1001", State: "REVIEWER"},
+		{Reviewer: "1002", State: "REVIEWER"},
+		{Reviewer: "Core Team", State: "CC"},
+	}, review.Reviewers)
+	if assert.Len(t, review.RemoveFromAttentionSet, 1) {
+		assert.Equal(t, "self", review.RemoveFromAttentionSet[0].User)
+	}
+	assert.Contains(t, metadata, resource.MetadataField{Name: "reviewer added", Value: "Jane Doe <jane@example.com>"})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "reviewer added", Value: "1001"})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "reviewer added", Value: "CI <ci@example.com>"})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "cc added", Value: "Core Team"})
+}
+
+func TestOutReviewersFile(t *testing.T) {
+	err := ioutil.WriteFile(
+		filepath.Join(testTempDir, "reviewers.yaml"),
+		[]byte("reviewers: [jane]\nccs: [1001]\n"), 0600)
+	assert.NoError(t, err)
+	testOut(t, Source{}, outParams{Reviewers: []string{"1003"}, ReviewersFile: "reviewers.yaml"})
+	assert.Equal(t, []gerrit.ReviewerInput{
+		{Reviewer: "1003", State: "REVIEWER"},
+		{Reviewer: "1000", State: "REVIEWER"},
+		{Reviewer: "1001", State: "CC"},
+	}, testGerritLastReviewInput.Reviewers)
+
+	err = ioutil.WriteFile(
+		filepath.Join(testTempDir, "reviewers.json"), []byte(`["jane", "Core Team"]`), 0600)
+	assert.NoError(t, err)
+	testOut(t, Source{}, outParams{ReviewersFile: "reviewers.json"})
+	assert.Equal(t, []gerrit.ReviewerInput{
+		{Reviewer: "1000", State: "REVIEWER"},
+		{Reviewer: "Core Team", State: "REVIEWER"},
+	}, testGerritLastReviewInput.Reviewers)
+}
+
+func TestOutReviewerAmbiguous(t *testing.T) {
+	err := testOutError(t, Source{}, outParams{Reviewers: []string{"example.com"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `reviewer "example.com" matches multiple accounts`)
+}
+
+func TestQuoteQuery(t *testing.T) {
+	assert.Equal(t, `"Core Team"`, quoteQuery("Core Team"))
+	assert.Equal(t, `"owner:self OR \"x\\y\""`, quoteQuery(`owner:self OR "x\y"`))
+}
+
+func TestOutHashtags(t *testing.T) {
+	testGerritLastHashtags = nil
+	testOut(t, Source{}, outParams{})
+	assert.Nil(t, testGerritLastHashtags)
+
+	_, metadata := testOut(t, Source{}, outParams{
+		AddHashtags:    []string{"ci-passed"},
+		RemoveHashtags: []string{"needs-rebase"},
+	})
+	assert.Equal(t, "outChange", testGerritLastChangeId)
+	assert.Equal(t, &gerrit.HashtagsInput{
+		Add:    []string{"ci-passed"},
+		Remove: []string{"needs-rebase"},
+	}, testGerritLastHashtags)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "hashtags", Value: "ci-passed"})
+}
+
+func TestOutTopic(t *testing.T) {
+	testGerritLastTopic = nil
+	testOut(t, Source{}, outParams{})
+	assert.Nil(t, testGerritLastTopic)
+
+	topic := "release-1.2"
+	_, metadata := testOut(t, Source{}, outParams{Topic: &topic})
+	if assert.NotNil(t, testGerritLastTopic) {
+		assert.Equal(t, "release-1.2", *testGerritLastTopic)
+	}
+	assert.Contains(t, metadata, resource.MetadataField{Name: "topic", Value: "release-1.2"})
+
+	topic = ""
+	testOut(t, Source{}, outParams{Topic: &topic})
+	if assert.NotNil(t, testGerritLastTopic) {
+		assert.Equal(t, "", *testGerritLastTopic)
+	}
+}
+
+func TestOutActionSubmit(t *testing.T) {
+	ver, metadata := testOut(t, Source{}, outParams{Action: "submit"})
+	assert.Equal(t, "submit", testGerritLastAction)
+	assert.Equal(t, "outChange", testGerritLastChangeId)
+	assert.Equal(t, "outChange", ver.ChangeId)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "status", Value: "MERGED"})
+}
+
+func TestOutActionSubmitNotSubmittable(t *testing.T) {
+	testGerritRevisionActions["submit"].Enabled = false
+	defer func() { testGerritRevisionActions["submit"].Enabled = true }()
+	testGerritLastAction = ""
+
+	err := testOutError(t, Source{}, outParams{Action: "submit"})
+	assert.Contains(t, err.Error(), "is not submittable")
+	assert.Equal(t, "", testGerritLastAction)
+}
+
+func TestOutActionSubmitNotMergeable(t *testing.T) {
+	testGerritMergeable = false
+	defer func() { testGerritMergeable = true }()
+	testGerritLastAction = ""
+
+	err := testOutError(t, Source{}, outParams{Action: "submit"})
+	assert.Contains(t, err.Error(), "is not mergeable")
+	assert.Equal(t, "", testGerritLastAction)
+}
+
+func TestOutActionAbandon(t *testing.T) {
+	_, metadata := testOut(t, Source{}, outParams{Action: "abandon", AbandonMessage: "Superseded"})
+	assert.Equal(t, "abandon", testGerritLastAction)
+	assert.Equal(t, "Superseded", testGerritLastActionInput["message"])
+	assert.Contains(t, metadata, resource.MetadataField{Name: "status", Value: "ABANDONED"})
+}
+
+func TestOutActionRebase(t *testing.T) {
+	ver, metadata := testOut(t, Source{}, outParams{Action: "rebase", RebaseBase: "abc123"})
+	assert.Equal(t, "rebase", testGerritLastAction)
+	assert.Equal(t, "abc123", testGerritLastActionInput["base"])
+	number := 100 + testGerritActionCount
+	assert.Equal(t, fmt.Sprintf("%s~%s~%s%d", testProject, testBranch, testChangeIdPrefix, number), ver.ChangeId)
+	assert.Equal(t, testRevisionPrefix+"0", ver.Revision)
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "rebased revision", Value: fmt.Sprintf("%s/c/%d/1", testGerritUrl, number)})
+}
+
+func TestOutActionMove(t *testing.T) {
+	_, metadata := testOut(t, Source{}, outParams{Action: "move", MoveBranch: "stable"})
+	assert.Equal(t, "move", testGerritLastAction)
+	assert.Equal(t, "stable", testGerritLastActionInput["destination_branch"])
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name:  "moved to stable",
+		Value: fmt.Sprintf("%s/c/%d/1", testGerritUrl, 100+testGerritActionCount)})
+}
+
+func TestOutActionCherryPick(t *testing.T) {
+	first := 100 + testGerritActionCount + 1
+	ver, metadata := testOut(t, Source{}, outParams{
+		Action:             "cherry_pick",
+		CherryPickBranches: []string{"release-1", "release-2"},
+	})
+	assert.Equal(t, "cherrypick", testGerritLastAction)
+	assert.Equal(t, "outRev", testGerritLastRevision)
+	assert.Equal(t, "release-2", testGerritLastActionInput["destination"])
+	assert.Equal(t, fmt.Sprintf("%s~%s~%s%d", testProject, testBranch, testChangeIdPrefix, first), ver.ChangeId)
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "cherry-picked to release-1", Value: fmt.Sprintf("%s/c/%d/1", testGerritUrl, first)})
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "cherry-picked to release-2", Value: fmt.Sprintf("%s/c/%d/1", testGerritUrl, first+1)})
+}
+
+func TestOutActionInvalid(t *testing.T) {
+	testGerritLastReviewInput = nil
+
+	err := testOutError(t, Source{}, outParams{Action: "merge"})
+	assert.Contains(t, err.Error(), `invalid action "merge"`)
+
+	err = testOutError(t, Source{}, outParams{Action: "cherry_pick"})
+	assert.Contains(t, err.Error(), "requires param cherry_pick_branches")
+	assert.Nil(t, testGerritLastReviewInput)
+}
+
+func TestOutActionSsh(t *testing.T) {
+	args, _ := testMockSsh(t, nil)
+	err := testOutError(t, Source{Api: "ssh"}, outParams{Message: "foo bar", Action: "submit"})
+	assert.Contains(t, err.Error(), `action "submit" not supported by api "ssh"`)
+	assert.Empty(t, *args)
+}
+
+func TestOutIfOutdated(t *testing.T) {
+	current := Version{ChangeId: testChangeIdPrefix + "7", Revision: testRevisionPrefix + "0"}
+	outdated := Version{ChangeId: testChangeIdPrefix + "7", Revision: "oldrev"}
+	params := outParams{Message: "Build passed", Labels: map[string]int{"Verified": 1}}
+
+	for _, test := range []struct {
+		ifOutdated string
+		ver        Version
+		decision   string
+		labels     map[string]int
+	}{
+		{"skip", current, "no", map[string]int{"Verified": 1}},
+		{"post", outdated, "posted", map[string]int{"Verified": 1}},
+		{"comment_only", outdated, "posted without votes", nil},
+		{"skip", outdated, "skipped", nil},
+	} {
+		testGerritLastReviewInput = nil
+		params.IfOutdated = test.ifOutdated
+		var resp testResourceResponse
+		assert.NoError(t, testOutAt(t, Source{}, test.ver, params, &resp))
+		assert.Contains(t, resp.Metadata, resource.MetadataField{Name: "outdated", Value: test.decision})
+		if test.decision == "skipped" {
+			assert.Nil(t, testGerritLastReviewInput)
+		} else if assert.NotNil(t, testGerritLastReviewInput) {
+			assert.Equal(t, "Build passed", testGerritLastReviewInput.Message)
+			assert.Equal(t, test.labels, testGerritLastReviewInput.Labels)
+		}
+	}
+}
+
+func TestOutIfOutdatedFail(t *testing.T) {
+	outdated := Version{ChangeId: testChangeIdPrefix + "7", Revision: "oldrev"}
+	err := testOutAt(t, Source{}, outdated, outParams{IfOutdated: "fail"}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `revision "oldrev" is outdated`)
+	}
+
+	err = testOutError(t, Source{}, outParams{IfOutdated: "never"})
+	assert.Contains(t, err.Error(), `invalid if_outdated "never"`)
+}
+
+func TestOutIdempotent(t *testing.T) {
+	os.Setenv("BUILD_ID", "42")
+	ver := Version{ChangeId: testChangeIdPrefix + "8", Revision: testRevisionPrefix + "0"}
+	params := outParams{Message: "Build passed", Idempotent: true}
+
+	testGerritLastReviewInput = nil
+	assert.NoError(t, testOutAt(t, Source{}, ver, params, &testResourceResponse{}))
+	if !assert.NotNil(t, testGerritLastReviewInput) {
+		return
+	}
+	tag := testGerritLastReviewInput.Tag
+	assert.Regexp(t, "^autogenerated:concourse:[0-9a-f]{16}$", tag)
+
+	testChangeMutators[8] = func(change *gerrit.ChangeInfo) {
+		change.Messages = append(change.Messages, gerrit.ChangeMessageInfo{Message: "Build passed", Tag: tag})
+	}
+	defer delete(testChangeMutators, 8)
+
+	testGerritLastReviewInput = nil
+	var resp testResourceResponse
+	assert.NoError(t, testOutAt(t, Source{}, ver, params, &resp))
+	assert.Nil(t, testGerritLastReviewInput)
+	assert.Contains(t, resp.Metadata, resource.MetadataField{Name: "review", Value: "already posted"})
+
+	// A different build posts again.
+	os.Setenv("BUILD_ID", "43")
+	assert.NoError(t, testOutAt(t, Source{}, ver, params, &testResourceResponse{}))
+	if assert.NotNil(t, testGerritLastReviewInput) {
+		assert.NotEqual(t, tag, testGerritLastReviewInput.Tag)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	os.Setenv("BUILD_ID", "42")
+	key := idempotencyKey(outParams{Message: "foo"}, testOutVersion)
+	assert.Equal(t, key, idempotencyKey(outParams{Message: "foo"}, testOutVersion))
+	assert.NotEqual(t, key, idempotencyKey(outParams{Message: "bar"}, testOutVersion))
+	assert.NotEqual(t, key, idempotencyKey(outParams{Message: "foo"}, Version{ChangeId: "other"}))
+}
+
+func TestOutChange(t *testing.T) {
+	changeId := fmt.Sprintf("%s~%s~%s9", testProject, testBranch, testChangeIdPrefix)
+	for _, test := range []struct {
+		params   outParams
+		revision string
+	}{
+		{outParams{Change: "9"}, testRevisionPrefix + "2"},
+		{outParams{Change: "9", PatchSet: 2}, testRevisionPrefix + "1"},
+		{outParams{Change: "9", Revision: testRevisionPrefix + "0"}, testRevisionPrefix + "0"},
+	} {
+		var resp testResourceResponse
+		test.params.Change = testChangeIdPrefix + test.params.Change
+		test.params.Message = "Nightly report"
+		assert.NoError(t, testOutAt(t, Source{}, Version{}, test.params, &resp))
+		assert.Equal(t, changeId, resp.Version.ChangeId)
+		assert.Equal(t, test.revision, resp.Version.Revision)
+		assert.Equal(t, changeId, testGerritLastChangeId)
+		assert.Equal(t, test.revision, testGerritLastRevision)
+	}
+
+	err := testOutAt(t, Source{}, Version{}, outParams{Change: testChangeIdPrefix + "9", PatchSet: 7}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `no patch set 7 on change`)
+	}
+}
+
+func TestOutVersionFile(t *testing.T) {
+	path := filepath.Join(testTempDir, "report-version.json")
+	os.Remove(path)
+	assert.NoError(t, testOutVersion.WriteToFile(path))
+
+	var resp testResourceResponse
+	assert.NoError(t, testOutAt(t, Source{}, Version{}, outParams{VersionFile: "report-version.json"}, &resp))
+	assert.Equal(t, "outChange", resp.Version.ChangeId)
+	assert.Equal(t, "outChange", testGerritLastChangeId)
+	assert.Equal(t, "outRev", testGerritLastRevision)
+}
+
+func TestOutConflictingTargets(t *testing.T) {
+	for _, test := range []struct {
+		params outParams
+		err    string
+	}{
+		{outParams{Repository: "repo", Change: "9"}, "only one of params repository, version_file and change"},
+		{outParams{VersionFile: "version.json", Change: "9"}, "only one of params repository, version_file and change"},
+		{outParams{Change: "9", Revision: "rev", PatchSet: 1}, "params revision and patch_set can't be used together"},
+		{outParams{VersionFile: "version.json", PatchSet: 1}, "params revision and patch_set require param change"},
+	} {
+		err := testOutAt(t, Source{}, Version{}, test.params, nil)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestOutNoTarget(t *testing.T) {
+	err := testOutAt(t, Source{}, Version{}, outParams{Message: "foo"}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "param repository, version_file or change required")
+	}
+}
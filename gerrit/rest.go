@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/build/gerrit"
+)
+
+// restApi is the REST gerritApi. Requests the gerrit client has no method for
+// are sent with do.
+type restApi struct {
+	*gerrit.Client
+	url     string
+	authMan *authManager
+}
+
+// do sends a request to path with body (if non-nil) as JSON, decoding the
+// response into out (if non-nil). It uses the gerrit client's http client and
+// the source's credentials.
+func (c restApi) do(ctx context.Context, method, path string, body, out interface{}) error {
+	auth, err := c.authMan.gerritAuth()
+	if err != nil {
+		return err
+	}
+	// See: https://gerrit-review.googlesource.com/Documentation/rest-api.html#authentication
+	if auth != gerrit.NoAuth {
+		path = "/a" + path
+	}
+
+	var reqBody []byte
+	if body != nil {
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	client := c.Client.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := c.send(ctx, client, method, c.url+path, reqBody)
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		// With digest auth, answer the server's challenge and try again.
+		var retry bool
+		retry, err = c.authMan.setDigestChallenge(res.Header.Get("WWW-Authenticate"))
+		if retry {
+			res.Body.Close()
+			res, err = c.send(ctx, client, method, c.url+path, reqBody)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, err := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return &gerrit.HTTPError{Res: res, Body: resBody, BodyErr: err}
+	}
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	// Skip the XSSI prefix line, ")]}'".
+	br := bufio.NewReader(res.Body)
+	if _, err := br.ReadSlice('\n'); err != nil {
+		return err
+	}
+	return json.NewDecoder(br).Decode(out)
+}
+
+// send sends an authenticated request with body (if non-nil) as JSON.
+func (c restApi) send(
+	ctx context.Context,
+	client *http.Client,
+	method, url string,
+	body []byte,
+) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	err = c.authMan.setRequestAuth(req)
+	if err != nil {
+		return nil, fmt.Errorf("error setting Gerrit auth: %v", err)
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	defaultReviewTag = "autogenerated:concourse"
+)
+
+// validNotify are the values of ReviewInput notify.
+var validNotify = map[string]bool{
+	"NONE":            true,
+	"OWNER":           true,
+	"OWNER_REVIEWERS": true,
+	"ALL":             true,
+}
+
+// reviewInput is the body of a set review request. It has fields
+// gerrit.ReviewInput lacks.
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#review-input
+type reviewInput struct {
+	Message                string                         `json:"message,omitempty"`
+	Labels                 map[string]int                 `json:"labels,omitempty"`
+	Tag                    string                         `json:"tag,omitempty"`
+	Comments               map[string][]commentInput      `json:"comments,omitempty"`
+	RobotComments          map[string][]robotCommentInput `json:"robot_comments,omitempty"`
+	Reviewers              []gerrit.ReviewerInput         `json:"reviewers,omitempty"`
+	OmitDuplicateComments  bool                           `json:"omit_duplicate_comments,omitempty"`
+	Notify                 string                         `json:"notify,omitempty"`
+	NotifyDetails          map[string]notifyInfo          `json:"notify_details,omitempty"`
+	AddToAttentionSet      []attentionSetInput            `json:"add_to_attention_set,omitempty"`
+	RemoveFromAttentionSet []attentionSetInput            `json:"remove_from_attention_set,omitempty"`
+}
+
+type attentionSetInput struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+// notifyInfo lists accounts to notify, keyed in notify_details by recipient
+// type (TO, CC or BCC).
+type notifyInfo struct {
+	Accounts []string `json:"accounts" yaml:"accounts"`
+}
+
+// newReviewInput builds the review for out params, with labels_file
+// settings (if any) taking precedence.
+func newReviewInput(
+	params outParams,
+	labelsFromFile *labelsFile,
+	message string,
+	labels map[string]int,
+	buildUrl string,
+) (reviewInput, error) {
+	review := reviewInput{
+		Message:               message,
+		Labels:                labels,
+		Tag:                   params.Tag,
+		OmitDuplicateComments: params.OmitDuplicateComments,
+		Notify:                params.Notify,
+		NotifyDetails:         params.NotifyDetails,
+	}
+	if review.Tag == "" {
+		review.Tag = defaultReviewTag
+	}
+	if labelsFromFile != nil {
+		if labelsFromFile.Notify != "" {
+			review.Notify = labelsFromFile.Notify
+		}
+		if labelsFromFile.NotifyDetails != nil {
+			review.NotifyDetails = labelsFromFile.NotifyDetails
+		}
+	}
+	if review.Notify != "" && !validNotify[review.Notify] {
+		return review, fmt.Errorf(
+			"invalid notify %q: want NONE, OWNER, OWNER_REVIEWERS or ALL", review.Notify)
+	}
+
+	reason := params.AttentionSetReason
+	if reason == "" {
+		reason = "Concourse build " + buildUrl
+	}
+	for _, user := range params.AddToAttentionSet {
+		review.AddToAttentionSet = append(review.AddToAttentionSet, attentionSetInput{user, reason})
+	}
+	removeFromAttentionSet := params.RemoveFromAttentionSet
+	if params.RemoveOwnAttention {
+		removeFromAttentionSet = append(removeFromAttentionSet, "self")
+	}
+	for _, user := range removeFromAttentionSet {
+		review.RemoveFromAttentionSet = append(review.RemoveFromAttentionSet, attentionSetInput{user, reason})
+	}
+	return review, nil
+}
+
+type commentRange struct {
+	StartLine      int `json:"start_line"`
+	StartCharacter int `json:"start_character"`
+	EndLine        int `json:"end_line"`
+	EndCharacter   int `json:"end_character"`
+}
+
+type commentInput struct {
+	Line       int           `json:"line,omitempty"`
+	Range      *commentRange `json:"range,omitempty"`
+	Message    string        `json:"message"`
+	Unresolved *bool         `json:"unresolved,omitempty"`
+}
+
+type robotCommentInput struct {
+	commentInput
+	RobotId        string            `json:"robot_id"`
+	RobotRunId     string            `json:"robot_run_id"`
+	Url            string            `json:"url,omitempty"`
+	Properties     map[string]string `json:"properties,omitempty"`
+	FixSuggestions []fixSuggestion   `json:"fix_suggestions,omitempty"`
+}
+
+type fixSuggestion struct {
+	Description  string           `json:"description"`
+	Replacements []fixReplacement `json:"replacements"`
+}
+
+type fixReplacement struct {
+	Path        string       `json:"path"`
+	Range       commentRange `json:"range"`
+	Replacement string       `json:"replacement"`
+}
+
+// SetReview posts review, which has fields gerrit.ReviewInput lacks.
+func (c restApi) SetReview(ctx context.Context, changeID, revision string, review reviewInput) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/changes/%s/revisions/%s/review",
+		url.PathEscape(changeID), url.PathEscape(revision)), review, nil)
+}
+
+// SetTopic sets the change's topic, or deletes it if topic is empty.
+func (c restApi) SetTopic(ctx context.Context, changeID, topic string) error {
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/changes/%s/topic", url.PathEscape(changeID)),
+		map[string]string{"topic": topic}, nil)
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+	"gopkg.in/yaml.v3"
+)
+
+var accountIdRe = regexp.MustCompile(`^\d+$`)
+
+// reviewersFile is a reviewers_file: either an object with reviewers and ccs
+// lists, or just a list of reviewers.
+type reviewersFile struct {
+	Reviewers []string `yaml:"reviewers"`
+	Ccs       []string `yaml:"ccs"`
+}
+
+func readReviewersFile(path string) (reviewersFile, error) {
+	var rf reviewersFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rf, fmt.Errorf("error reading reviewers file %q: %v", path, err)
+	}
+	// JSON is valid YAML
+	err = yaml.Unmarshal(data, &rf)
+	if err != nil {
+		err = yaml.Unmarshal(data, &rf.Reviewers)
+	}
+	if err != nil {
+		return rf, fmt.Errorf("error parsing reviewers file %q: %v", path, err)
+	}
+	return rf, nil
+}
+
+// resolveReviewer resolves name to an account ID and display name. Names
+// matching no account (like group names) are returned as is for Gerrit to
+// resolve.
+func resolveReviewer(c gerritApi, ctx context.Context, name string) (string, string, error) {
+	if accountIdRe.MatchString(name) {
+		return name, name, nil
+	}
+	accounts, err := c.QueryAccounts(ctx, quoteQuery(name),
+		gerrit.QueryAccountsOpt{N: 2, Fields: []string{"DETAILS"}})
+	if err != nil {
+		return "", "", fmt.Errorf("error looking up reviewer %q: %v", name, err)
+	}
+	var match *gerrit.AccountInfo
+	switch len(accounts) {
+	case 0:
+		return name, name, nil
+	case 1:
+		match = accounts[0]
+	default:
+		for _, account := range accounts {
+			if strings.EqualFold(account.Email, name) || account.Username == name {
+				match = account
+			}
+		}
+		if match == nil {
+			return "", "", fmt.Errorf("reviewer %q matches multiple accounts", name)
+		}
+	}
+
+	display := match.Name
+	if match.Email != "" {
+		display = fmt.Sprintf("%s <%s>", match.Name, match.Email)
+	}
+	return strconv.FormatInt(match.NumericID, 10), strings.TrimSpace(display), nil
+}
+
+// quoteQuery quotes s as a single query term, so operators, spaces and
+// parentheses in it aren't parsed by Gerrit.
+func quoteQuery(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// addReviewers adds the reviewers and ccs to review, returning metadata
+// naming who was added.
+func addReviewers(
+	c gerritApi,
+	ctx context.Context,
+	reviewers []string,
+	ccs []string,
+	review *reviewInput,
+) ([][2]string, error) {
+	var added [][2]string
+	for _, state := range []struct {
+		names    []string
+		state    string
+		metadata string
+	}{
+		{reviewers, "REVIEWER", "reviewer added"},
+		{ccs, "CC", "cc added"},
+	} {
+		for _, name := range state.names {
+			id, display, err := resolveReviewer(c, ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			review.Reviewers = append(review.Reviewers, gerrit.ReviewerInput{
+				Reviewer: id,
+				State:    state.state,
+			})
+			added = append(added, [2]string{state.metadata, display})
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,420 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	defaultSshPort = "29418"
+
+	// Key of change messages in sshClient.ListChangeComments results.
+	sshMessagesPath = "/PATCHSET_LEVEL"
+)
+
+var (
+	// For testing
+	execSsh = realExecSsh
+)
+
+// sshClient implements gerritApi with Gerrit's ssh commands.
+type sshClient struct {
+	host    string
+	port    string
+	user    string
+	sshArgs []string
+}
+
+func newSshClient(src Source, authMan *authManager) (*sshClient, error) {
+	sshUrl := src.SshUrl
+	if sshUrl == "" {
+		u, err := url.Parse(src.Url)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("can't derive ssh_url from url %q", src.Url)
+		}
+		sshUrl = fmt.Sprintf("ssh://%s:%s", u.Hostname(), defaultSshPort)
+	}
+	u, err := url.Parse(sshUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh_url %q: %v", sshUrl, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ssh_url %q: want ssh://[user@]host[:port]", sshUrl)
+	}
+	c := &sshClient{
+		host: u.Hostname(),
+		port: u.Port(),
+		user: u.User.Username(),
+	}
+	if c.port == "" {
+		c.port = defaultSshPort
+	}
+	if c.user == "" {
+		c.user = src.PrivateKeyUser
+	}
+
+	err = authMan.verifyHostKeys(fmt.Sprintf("ssh://%s:%s", c.host, c.port))
+	if err != nil {
+		return nil, err
+	}
+	c.sshArgs, err = authMan.sshArgs()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// run runs a gerrit ssh command with stdin as its input.
+func (c *sshClient) run(stdin []byte, command ...string) ([]byte, error) {
+	target := c.host
+	if c.user != "" {
+		target = c.user + "@" + c.host
+	}
+	args := append(append([]string{}, c.sshArgs...), "-p", c.port, target, shellJoin(command))
+	output, err := execSsh(stdin, args...)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("error running %q: %v", strings.Join(command[:2], " "), err)
+	}
+	return output, nil
+}
+
+func (c *sshClient) QueryChanges(ctx context.Context, q string, opts ...gerrit.QueryChangesOpt) ([]*gerrit.ChangeInfo, error) {
+	var opt gerrit.QueryChangesOpt
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	args := []string{"gerrit", "query", "--format=JSON", "--current-patch-set"}
+	for _, field := range opt.Fields {
+		switch field {
+		case "ALL_REVISIONS":
+			args = append(args, "--patch-sets")
+		case "MESSAGES":
+			args = append(args, "--comments")
+		}
+	}
+	if opt.N > 0 {
+		q = fmt.Sprintf("(%s) limit:%d", q, opt.N)
+	}
+	output, err := c.run(nil, append(args, q)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseSshQuery(output)
+}
+
+func (c *sshClient) GetChange(ctx context.Context, changeID string, opts ...gerrit.QueryChangesOpt) (*gerrit.ChangeInfo, error) {
+	changes, err := c.QueryChanges(ctx, sshChangeQuery(changeID), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("change %q not found", changeID)
+	}
+	return changes[0], nil
+}
+
+// ListChangeComments returns change messages; inline comments in ssh query
+// results have no timestamps.
+func (c *sshClient) ListChangeComments(ctx context.Context, changeID string) (map[string][]gerrit.CommentInfo, error) {
+	change, err := c.GetChange(ctx, changeID, gerrit.QueryChangesOpt{Fields: []string{"MESSAGES"}})
+	if err != nil {
+		return nil, err
+	}
+	var comments []gerrit.CommentInfo
+	for _, message := range change.Messages {
+		comments = append(comments, gerrit.CommentInfo{
+			Message: message.Message,
+			Updated: message.Time,
+			Author:  message.Author,
+		})
+	}
+	return map[string][]gerrit.CommentInfo{sshMessagesPath: comments}, nil
+}
+
+func (c *sshClient) ListFiles(ctx context.Context, changeID, revision string) (map[string]*gerrit.FileInfo, error) {
+	output, err := c.run(nil, "gerrit", "query", "--format=JSON", "--patch-sets", "--files",
+		sshChangeQuery(changeID))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := parseSshQueryRows(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, ps := range row.PatchSets {
+			if ps.Revision != revision {
+				continue
+			}
+			files := make(map[string]*gerrit.FileInfo)
+			for _, file := range ps.Files {
+				files[file.File] = &gerrit.FileInfo{
+					Status:        sshFileStatus[file.Type],
+					LinesInserted: file.Insertions,
+					LinesDeleted:  -file.Deletions,
+				}
+			}
+			return files, nil
+		}
+	}
+	return nil, fmt.Errorf("no revision %q on change %q", revision, changeID)
+}
+
+// QueryAccounts finds no accounts; there is no ssh account query, so
+// reviewers are passed to gerrit review as named.
+func (c *sshClient) QueryAccounts(ctx context.Context, q string, opts ...gerrit.QueryAccountsOpt) ([]*gerrit.AccountInfo, error) {
+	return nil, nil
+}
+
+func (c *sshClient) SetReview(ctx context.Context, changeID, revision string, review reviewInput) error {
+	input, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	args := []string{"gerrit", "review", "--json"}
+	if project, _, _, ok := splitChangeTriplet(changeID); ok {
+		args = append(args, "--project", project)
+	}
+	_, err = c.run(input, append(args, revision)...)
+	return err
+}
+
+// SetHashtags updates the change's hashtags. gerrit set-hashtags doesn't
+// print the resulting hashtags, so none are returned.
+func (c *sshClient) SetHashtags(ctx context.Context, changeID string, hashtags gerrit.HashtagsInput) ([]string, error) {
+	args := []string{"gerrit", "set-hashtags", changeID}
+	for _, tag := range hashtags.Add {
+		args = append(args, "--add", tag)
+	}
+	for _, tag := range hashtags.Remove {
+		args = append(args, "--remove", tag)
+	}
+	_, err := c.run(nil, args...)
+	return nil, err
+}
+
+func (c *sshClient) SetTopic(ctx context.Context, changeID, topic string) error {
+	_, err := c.run(nil, "gerrit", "set-topic", changeID, "--topic", topic)
+	return err
+}
+
+// splitChangeTriplet splits a "project~branch~Change-Id" change ID.
+func splitChangeTriplet(changeID string) (project, branch, id string, ok bool) {
+	parts := strings.Split(changeID, "~")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	project, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", "", false
+	}
+	branch, err = url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", "", false
+	}
+	return project, branch, parts[2], true
+}
+
+func sshChangeQuery(changeID string) string {
+	if project, branch, id, ok := splitChangeTriplet(changeID); ok {
+		return fmt.Sprintf("project:{%s} branch:{%s} change:%s", project, branch, id)
+	}
+	return "change:" + changeID
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/json.html
+type sshAccount struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type sshPatchSet struct {
+	Number    int        `json:"number"`
+	Revision  string     `json:"revision"`
+	Ref       string     `json:"ref"`
+	Uploader  sshAccount `json:"uploader"`
+	CreatedOn int64      `json:"createdOn"`
+	Kind      string     `json:"kind"`
+	Files     []sshFile  `json:"files"`
+}
+
+type sshFile struct {
+	File       string `json:"file"`
+	Type       string `json:"type"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+}
+
+// sshFileStatus maps ssh file types to REST file statuses.
+var sshFileStatus = map[string]string{
+	"ADDED":    "A",
+	"DELETED":  "D",
+	"RENAMED":  "R",
+	"COPIED":   "C",
+	"REWRITE":  "W",
+	"MODIFIED": "",
+}
+
+type sshMessage struct {
+	Timestamp int64      `json:"timestamp"`
+	Reviewer  sshAccount `json:"reviewer"`
+	Message   string     `json:"message"`
+}
+
+type sshChange struct {
+	// Set on the trailing "stats" row and on "error" rows.
+	Type         string `json:"type"`
+	ErrorMessage string `json:"message"`
+
+	Project         string        `json:"project"`
+	Branch          string        `json:"branch"`
+	Topic           string        `json:"topic"`
+	Id              string        `json:"id"`
+	Number          int           `json:"number"`
+	Subject         string        `json:"subject"`
+	Owner           sshAccount    `json:"owner"`
+	Hashtags        []string      `json:"hashtags"`
+	CreatedOn       int64         `json:"createdOn"`
+	LastUpdated     int64         `json:"lastUpdated"`
+	Status          string        `json:"status"`
+	CommitMessage   string        `json:"commitMessage"`
+	CurrentPatchSet *sshPatchSet  `json:"currentPatchSet"`
+	PatchSets       []sshPatchSet `json:"patchSets"`
+	Comments        []sshMessage  `json:"comments"`
+}
+
+// parseSshQuery parses the output of gerrit query --format=JSON, one JSON
+// object per line.
+func parseSshQuery(output []byte) ([]*gerrit.ChangeInfo, error) {
+	rows, err := parseSshQueryRows(output)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*gerrit.ChangeInfo
+	for _, row := range rows {
+		changes = append(changes, row.changeInfo())
+	}
+	return changes, nil
+}
+
+func parseSshQueryRows(output []byte) ([]sshChange, error) {
+	var rows []sshChange
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var row sshChange
+		err := json.Unmarshal(line, &row)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ssh query output: %v", err)
+		}
+		switch row.Type {
+		case "":
+			rows = append(rows, row)
+		case "stats":
+		case "error":
+			return nil, errors.New(row.ErrorMessage)
+		default:
+			return nil, fmt.Errorf("unexpected ssh query row type %q", row.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ssh query output: %v", err)
+	}
+	return rows, nil
+}
+
+// changeInfo converts the change to its REST representation.
+func (sc sshChange) changeInfo() *gerrit.ChangeInfo {
+	change := &gerrit.ChangeInfo{
+		ID: fmt.Sprintf("%s~%s~%s",
+			url.PathEscape(sc.Project), url.PathEscape(sc.Branch), sc.Id),
+		ChangeNumber: sc.Number,
+		ChangeID:     sc.Id,
+		Project:      sc.Project,
+		Branch:       sc.Branch,
+		Topic:        sc.Topic,
+		Hashtags:     sc.Hashtags,
+		Subject:      sc.Subject,
+		Status:       sc.Status,
+		Created:      sshTimeStamp(sc.CreatedOn),
+		Updated:      sshTimeStamp(sc.LastUpdated),
+		Owner:        sc.Owner.accountInfo(),
+		Revisions:    make(map[string]gerrit.RevisionInfo),
+	}
+	patchSets := sc.PatchSets
+	if sc.CurrentPatchSet != nil {
+		change.CurrentRevision = sc.CurrentPatchSet.Revision
+		patchSets = append(patchSets, *sc.CurrentPatchSet)
+	}
+	for _, ps := range patchSets {
+		revision := gerrit.RevisionInfo{
+			PatchSetNumber: ps.Number,
+			Created:        sshTimeStamp(ps.CreatedOn),
+			Uploader:       ps.Uploader.accountInfo(),
+			Ref:            ps.Ref,
+			Kind:           ps.Kind,
+		}
+		if ps.Revision == change.CurrentRevision && sc.CommitMessage != "" {
+			revision.Commit = &gerrit.CommitInfo{
+				CommitID: ps.Revision,
+				Subject:  sc.Subject,
+				Message:  sc.CommitMessage,
+			}
+		}
+		change.Revisions[ps.Revision] = revision
+	}
+	for _, message := range sc.Comments {
+		change.Messages = append(change.Messages, gerrit.ChangeMessageInfo{
+			Author:  message.Reviewer.accountInfo(),
+			Time:    sshTimeStamp(message.Timestamp),
+			Message: message.Message,
+		})
+	}
+	return change
+}
+
+func (sa sshAccount) accountInfo() *gerrit.AccountInfo {
+	return &gerrit.AccountInfo{Name: sa.Name, Email: sa.Email, Username: sa.Username}
+}
+
+func sshTimeStamp(seconds int64) gerrit.TimeStamp {
+	return gerrit.TimeStamp(time.Unix(seconds, 0).UTC())
+}
+
+func realExecSsh(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	return cmd.Output()
+}
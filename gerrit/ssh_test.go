@@ -0,0 +1,182 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	testSshChangeId  = "tools%2Fbuild~master~I4d9d3e9b1d0e1c2a7f0b6a5c3e2d1f0a9b8c7d6e"
+	testSshRevision1 = "1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d"
+	testSshRevision2 = "9f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c"
+)
+
+func testSshFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	assert.NoError(t, err)
+	return data
+}
+
+// testMockSsh replaces ssh execution with one returning output, recording
+// the args and stdin of the last call.
+func testMockSsh(t *testing.T, output []byte) (args *[]string, stdin *[]byte) {
+	args = new([]string)
+	stdin = new([]byte)
+	execSsh = func(in []byte, a ...string) ([]byte, error) {
+		*args = a
+		*stdin = in
+		return output, nil
+	}
+	t.Cleanup(func() { execSsh = realExecSsh })
+	return
+}
+
+func TestParseSshQuery(t *testing.T) {
+	changes, err := parseSshQuery(testSshFixture(t, "ssh_query.json"))
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+
+	change := changes[0]
+	assert.Equal(t, testSshChangeId, change.ID)
+	assert.Equal(t, 1234, change.ChangeNumber)
+	assert.Equal(t, "tools/build", change.Project)
+	assert.Equal(t, "master", change.Branch)
+	assert.Equal(t, "Fix the build", change.Subject)
+	assert.Equal(t, "NEW", change.Status)
+	assert.Equal(t, []string{"ci"}, change.Hashtags)
+	assert.Equal(t, "jane", change.Owner.Username)
+	assert.True(t, time.Unix(1500007200, 0).Equal(change.Updated.Time()))
+	assert.Equal(t, testSshRevision2, change.CurrentRevision)
+
+	assert.Len(t, change.Revisions, 2)
+	rev := change.Revisions[testSshRevision1]
+	assert.Equal(t, 1, rev.PatchSetNumber)
+	assert.Equal(t, "refs/changes/34/1234/1", rev.Ref)
+	assert.True(t, time.Unix(1500000000, 0).Equal(rev.Created.Time()))
+	assert.Nil(t, rev.Commit)
+	rev = change.Revisions[testSshRevision2]
+	assert.Equal(t, "TRIVIAL_REBASE", rev.Kind)
+	assert.Contains(t, rev.Commit.Message, "Bug: 42\n")
+
+	assert.Len(t, change.Messages, 3)
+	assert.Equal(t, "Patch Set 1:\n\nrecheck", change.Messages[1].Message)
+	assert.Equal(t, "john", change.Messages[1].Author.Username)
+
+	assert.Equal(t, "tools%2Fbuild~release-1.0~I0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d", changes[1].ID)
+	assert.Len(t, changes[1].Revisions, 1)
+	assert.Empty(t, changes[1].Messages)
+}
+
+func TestParseSshQueryError(t *testing.T) {
+	_, err := parseSshQuery(testSshFixture(t, "ssh_query_error.json"))
+	assert.EqualError(t, err, "Unsupported operator: bogus")
+}
+
+func TestSshChangeQuery(t *testing.T) {
+	assert.Equal(t,
+		"project:{tools/build} branch:{master} change:I4d9d3e9b1d0e1c2a7f0b6a5c3e2d1f0a9b8c7d6e",
+		sshChangeQuery(testSshChangeId))
+	assert.Equal(t, "change:1234", sshChangeQuery("1234"))
+}
+
+func TestCheckSsh(t *testing.T) {
+	args, _ := testMockSsh(t, testSshFixture(t, "ssh_query.json"))
+
+	versions := testCheck(t, Source{
+		Api:              "ssh",
+		SshUrl:           "ssh://ci@review.example.com",
+		PatchsetVersions: "every",
+	}, Version{
+		ChangeId: testSshChangeId,
+		Revision: testSshRevision1,
+		Created:  time.Unix(1500000000, 0),
+	})
+	assert.Equal(t, []string{
+		"-F", "/dev/null", "-o", "StrictHostKeyChecking=no",
+		"-p", "29418", "ci@review.example.com",
+		"gerrit query --format=JSON --current-patch-set --patch-sets " +
+			"'(status:open) AND after:{2017-07-14 02:40:00}'",
+	}, *args)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, testSshRevision1, versions[0].Revision)
+		assert.Equal(t, testSshChangeId, versions[1].ChangeId)
+		assert.Equal(t, testSshRevision2, versions[1].Revision)
+		assert.Equal(t, time.Unix(1500007200, 0).UTC(), versions[1].Created.UTC())
+	}
+}
+
+func TestCheckSshDefaultUrl(t *testing.T) {
+	args, _ := testMockSsh(t, testSshFixture(t, "ssh_query.json"))
+
+	testCheck(t, Source{Api: "ssh", PrivateKeyUser: "ci"}, Version{})
+	assert.Contains(t, *args, "ci@localhost")
+	assert.Contains(t, *args, "29418")
+	assert.Contains(t, *args, "gerrit query --format=JSON --current-patch-set '(status:open) limit:1'")
+}
+
+func TestOutSsh(t *testing.T) {
+	args, stdin := testMockSsh(t, nil)
+
+	testOut(t, Source{Api: "ssh"}, outParams{Message: "it's fine", Labels: map[string]int{"Verified": 1}})
+	assert.Equal(t, "gerrit review --json outRev", (*args)[len(*args)-1])
+	var review reviewInput
+	assert.NoError(t, json.Unmarshal(*stdin, &review))
+	assert.Equal(t, "it's fine", review.Message)
+	assert.Equal(t, map[string]int{"Verified": 1}, review.Labels)
+}
+
+func TestSshSetHashtags(t *testing.T) {
+	args, _ := testMockSsh(t, nil)
+
+	c := &sshClient{host: "review.example.com", port: "29418"}
+	hashtags, err := c.SetHashtags(context.Background(), "12345", gerrit.HashtagsInput{
+		Add:    []string{"ci-passed"},
+		Remove: []string{"needs-rebase"},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, hashtags)
+	assert.Equal(t,
+		"gerrit set-hashtags 12345 --add ci-passed --remove needs-rebase",
+		(*args)[len(*args)-1])
+}
+
+func TestSshSetTopic(t *testing.T) {
+	args, _ := testMockSsh(t, nil)
+
+	c := &sshClient{host: "review.example.com", port: "29418"}
+	assert.NoError(t, c.SetTopic(context.Background(), "12345", "release 1.2"))
+	assert.Equal(t,
+		"gerrit set-topic 12345 --topic 'release 1.2'",
+		(*args)[len(*args)-1])
+}
+
+func TestSshSetReviewProject(t *testing.T) {
+	args, _ := testMockSsh(t, nil)
+
+	c := &sshClient{host: "review.example.com", port: "29418"}
+	assert.NoError(t, c.SetReview(context.Background(), testSshChangeId, testSshRevision2, reviewInput{}))
+	assert.Equal(t,
+		"gerrit review --json --project tools/build "+testSshRevision2,
+		(*args)[len(*args)-1])
+}
@@ -0,0 +1,257 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Gerrit's default change.commentSizeLimit.
+	defaultMaxMessageLength = 16 << 10
+
+	truncatedSuffix = "\n\n(truncated)"
+)
+
+var (
+	templateFuncs = template.FuncMap{
+		"truncate": truncateString,
+		"markdown": markdownEscaper.Replace,
+		"join":     func(sep string, items []string) string { return strings.Join(items, sep) },
+	}
+
+	markdownEscaper = strings.NewReplacer(
+		`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+		"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`,
+	)
+)
+
+// messageBuild is the build metadata in message templates.
+type messageBuild struct {
+	Id             string
+	Name           string
+	JobName        string
+	PipelineName   string
+	TeamName       string
+	AtcExternalUrl string
+	Url            string
+}
+
+// messageChange is the reviewed change in message templates.
+type messageChange struct {
+	Project  string
+	Branch   string
+	Number   int
+	Subject  string
+	Status   string
+	Owner    string
+	PatchSet int
+	Files    []string
+	// Labels maps labels to their lowest negative vote, or else highest
+	// vote.
+	Labels map[string]int
+}
+
+// messageData is the data message templates are executed with.
+type messageData struct {
+	Build   messageBuild
+	Version Version
+	// Vars are the ${...} message variables, by name.
+	Vars map[string]string
+	// Data are the template_data files, by name.
+	Data map[string]interface{}
+
+	c      gerritApi
+	ctx    context.Context
+	change *messageChange
+}
+
+func newMessageData(
+	c gerritApi,
+	ctx context.Context,
+	ver Version,
+	variableTokens map[string]string,
+	dataFiles map[string]string,
+) (*messageData, error) {
+	data := &messageData{
+		Build: messageBuild{
+			Id:             os.Getenv("BUILD_ID"),
+			Name:           os.Getenv("BUILD_NAME"),
+			JobName:        os.Getenv("BUILD_JOB_NAME"),
+			PipelineName:   os.Getenv("BUILD_PIPELINE_NAME"),
+			TeamName:       os.Getenv("BUILD_TEAM_NAME"),
+			AtcExternalUrl: os.Getenv("ATC_EXTERNAL_URL"),
+			Url:            buildUrl(),
+		},
+		Version: ver,
+		Vars:    make(map[string]string),
+		Data:    make(map[string]interface{}),
+		c:       c,
+		ctx:     ctx,
+	}
+	for token, value := range variableTokens {
+		data.Vars[strings.TrimSuffix(strings.TrimPrefix(token, "${"), "}")] = value
+	}
+	for name, path := range dataFiles {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template data %q: %v", name, err)
+		}
+		var value interface{}
+		// JSON is valid YAML
+		err = yaml.Unmarshal(contents, &value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template data %q: %v", name, err)
+		}
+		data.Data[name] = value
+	}
+	return data, nil
+}
+
+// Change returns the reviewed change, fetched on first use.
+func (d *messageData) Change() (*messageChange, error) {
+	if d.change != nil {
+		return d.change, nil
+	}
+	change, rev, err := getVersionChangeRevision(d.c, d.ctx, d.Version, "DETAILED_LABELS")
+	if err != nil {
+		return nil, err
+	}
+	files, err := d.c.ListFiles(d.ctx, d.Version.ChangeId, d.Version.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files of %q: %v", d.Version.ChangeId, err)
+	}
+
+	mc := &messageChange{
+		Project:  change.Project,
+		Branch:   change.Branch,
+		Number:   change.ChangeNumber,
+		Subject:  change.Subject,
+		Status:   change.Status,
+		PatchSet: rev.PatchSetNumber,
+		Labels:   make(map[string]int),
+	}
+	if owner := change.Owner; owner != nil {
+		mc.Owner = owner.Name
+		if owner.Email != "" {
+			mc.Owner = strings.TrimSpace(fmt.Sprintf("%s <%s>", owner.Name, owner.Email))
+		}
+	}
+	for file := range files {
+		// Skip magic files like /COMMIT_MSG
+		if !strings.HasPrefix(file, "/") {
+			mc.Files = append(mc.Files, file)
+		}
+	}
+	sort.Strings(mc.Files)
+	for label, info := range change.Labels {
+		min, max := 0, 0
+		for _, approval := range info.All {
+			if approval.Value < min {
+				min = approval.Value
+			}
+			if approval.Value > max {
+				max = approval.Value
+			}
+		}
+		if min < 0 {
+			mc.Labels[label] = min
+		} else {
+			mc.Labels[label] = max
+		}
+	}
+	d.change = mc
+	return mc, nil
+}
+
+// renderMessage executes message as a template with data.
+func renderMessage(message string, data *messageData) (string, error) {
+	tmpl, err := template.New("message").Funcs(templateFuncs).Parse(message)
+	if err != nil {
+		return "", fmt.Errorf("error parsing message template: %v", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("error executing message template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// truncateString returns s cut to at most n bytes, ending in "..." if cut.
+func truncateString(n int, s string) string {
+	if len(s) <= n {
+		return s
+	}
+	if n <= 3 {
+		return truncateBytes(s, n)
+	}
+	return truncateBytes(s, n-3) + "..."
+}
+
+// varActions replaces the ${...} variable tokens in a template with actions
+// rendering the variables, e.g. ${BUILD_ID} with {{index .Vars "BUILD_ID"}}.
+func varActions(variableTokens map[string]string) *strings.Replacer {
+	var oldnew []string
+	for token := range variableTokens {
+		name := strings.TrimSuffix(strings.TrimPrefix(token, "${"), "}")
+		oldnew = append(oldnew, token, fmt.Sprintf("{{index .Vars %q}}", name))
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// maxMessageLength returns the max_message_length param or its default.
+func maxMessageLength(params outParams) int {
+	if params.MaxMessageLength <= 0 {
+		return defaultMaxMessageLength
+	}
+	return params.MaxMessageLength
+}
+
+// truncateMessage cuts message to at most max bytes, noting the cut if
+// there's room.
+func truncateMessage(message string, max int) string {
+	if len(message) <= max {
+		return message
+	}
+	if max <= len(truncatedSuffix) {
+		return truncateBytes(message, max)
+	}
+	return truncateBytes(message, max-len(truncatedSuffix)) + truncatedSuffix
+}
+
+// truncateBytes cuts s to at most n bytes without splitting a character.
+func truncateBytes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/build/gerrit"
+)
+
+func TestOutMessageTemplate(t *testing.T) {
+	os.Setenv("BUILD_ID", "5")
+	testChangeMutators[11] = func(change *gerrit.ChangeInfo) {
+		change.Owner = &gerrit.AccountInfo{Name: testName, Email: testEmail}
+		change.Labels = map[string]gerrit.LabelInfo{
+			"Code-Review": {All: []gerrit.ApprovalInfo{{Value: 2}, {Value: 1}}},
+			"Verified":    {All: []gerrit.ApprovalInfo{{Value: 1}, {Value: -1}}},
+		}
+	}
+	defer delete(testChangeMutators, 11)
+	err := ioutil.WriteFile(
+		filepath.Join(testTempDir, "coverage.json"), []byte(`{"percent": 87.5}`), 0600)
+	assert.NoError(t, err)
+
+	ver := Version{ChangeId: testChangeIdPrefix + "11", Revision: testRevisionPrefix + "1"}
+	params := outParams{
+		Message: strings.Join([]string{
+			"{{.Change.Subject}} (patch set {{.Change.PatchSet}}) by {{.Change.Owner}}",
+			`Files: {{.Change.Files | join ", "}}`,
+			"Votes: CR{{index .Change.Labels \"Code-Review\"}} V{{index .Change.Labels \"Verified\"}}",
+			"{{if eq .Build.Id \"5\"}}Build ${BUILD_ID}{{end}}, coverage {{.Data.coverage.percent}}%",
+			"{{.Change.Subject | truncate 8}} {{markdown \"*not bold*\"}}",
+		}, "\n"),
+		MessageTemplate: true,
+		TemplateData:    map[string]string{"coverage": "coverage.json"},
+	}
+	assert.NoError(t, testOutAt(t, Source{}, ver, params, &testResourceResponse{}))
+	assert.Equal(t, strings.Join([]string{
+		testSubject + " (patch set 2) by " + testName + " <" + testEmail + ">",
+		"Files: lib/util.go, main.go",
+		"Votes: CR2 V-1",
+		"Build 5, coverage 87.5%",
+		testSubject[:5] + "... \\*not bold\\*",
+	}, "\n"), testGerritLastReviewInput.Message)
+}
+
+func TestOutMessageTemplateVarsNotResubstituted(t *testing.T) {
+	os.Setenv("BUILD_ID", "5")
+	testChangeMutators[11] = func(change *gerrit.ChangeInfo) {
+		change.Subject = "Use ${BUILD_ID} {{.Nope}}"
+	}
+	defer delete(testChangeMutators, 11)
+
+	ver := Version{ChangeId: testChangeIdPrefix + "11", Revision: testRevisionPrefix + "1"}
+	params := outParams{
+		Message:         "{{.Change.Subject}} in build ${BUILD_ID}",
+		MessageTemplate: true,
+	}
+	assert.NoError(t, testOutAt(t, Source{}, ver, params, &testResourceResponse{}))
+	assert.Equal(t, "Use ${BUILD_ID} {{.Nope}} in build 5", testGerritLastReviewInput.Message)
+}
+
+func TestOutMessageTemplateError(t *testing.T) {
+	err := testOutError(t, Source{}, outParams{Message: "{{.Nope", MessageTemplate: true})
+	assert.Contains(t, err.Error(), "error parsing message template")
+
+	// Without message_template, braces are left alone.
+	testOut(t, Source{}, outParams{Message: "{{.Nope"})
+	assert.Equal(t, "{{.Nope", testGerritLastReviewInput.Message)
+}
+
+func TestOutMessageTruncated(t *testing.T) {
+	testOut(t, Source{}, outParams{
+		Message:          strings.Repeat("long message ", 10),
+		MaxMessageLength: 30,
+	})
+	assert.Equal(t, "long message long\n\n(truncated)", testGerritLastReviewInput.Message)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncateString(10, "short"))
+	assert.Equal(t, "trun...", truncateString(7, "truncated"))
+	assert.Equal(t, "tr", truncateString(2, "truncated"))
+	// Characters aren't split.
+	assert.Equal(t, "h...", truncateString(5, "héllo wörld"))
+	assert.Equal(t, "hé", truncateBytes("héllo", 3))
+	assert.Equal(t, "h", truncateBytes("héllo", 2))
+	assert.Equal(t, "a much \n\n(truncated)", truncateMessage("a much longer message than this", 20))
+	// Limits too small for the note just cut.
+	assert.Equal(t, "a mu", truncateMessage("a much longer message than this", 4))
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// tlsConfig returns the TLS configuration for Gerrit REST requests, or nil
+// if the source doesn't customize it.
+func (am *authManager) tlsConfig() (*tls.Config, error) {
+	if am.caCert == "" && am.clientCert == "" && am.clientKey == "" && !am.insecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: am.insecureSkipVerify}
+	if am.caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(am.caCert)) {
+			return nil, errors.New("no certificates found in ca_cert")
+		}
+		config.RootCAs = pool
+	}
+	if am.clientCert != "" || am.clientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(am.clientCert), []byte(am.clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client_cert and client_key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tlsGitConfigArgs adds the git http config matching tlsConfig to args.
+func (am *authManager) tlsGitConfigArgs(args map[string]string) error {
+	if am.insecureSkipVerify {
+		args["http.sslVerify"] = "false"
+	}
+	var err error
+	if am.caCert != "" {
+		if am.caCertPath_ == "" {
+			am.caCertPath_, err = writeAuthTempFile("concourse-gerrit-ca-cert", am.caCert)
+			if err != nil {
+				return err
+			}
+		}
+		args["http.sslCAInfo"] = am.caCertPath_
+	}
+	if am.clientCert != "" {
+		if am.clientCertPath_ == "" {
+			am.clientCertPath_, err = writeAuthTempFile("concourse-gerrit-client-cert", am.clientCert)
+			if err != nil {
+				return err
+			}
+		}
+		args["http.sslCert"] = am.clientCertPath_
+	}
+	if am.clientKey != "" {
+		if am.clientKeyPath_ == "" {
+			am.clientKeyPath_, err = writeAuthTempFile("concourse-gerrit-client-key", am.clientKey)
+			if err != nil {
+				return err
+			}
+		}
+		args["http.sslKey"] = am.clientKeyPath_
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+// testCertificate returns a self-signed client certificate and its key.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "concourse"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestCheckSourceTls(t *testing.T) {
+	clientCert, clientKey := testCertificate(t)
+	clientCAs := x509.NewCertPool()
+	assert.True(t, clientCAs.AppendCertsFromPEM([]byte(clientCert)))
+
+	var peerCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCerts = len(r.TLS.PeerCertificates)
+		testGerritHandler(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	req := testRequest{Source: Source{
+		Url:        server.URL,
+		CaCert:     caCert,
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+	}}
+	var versions []Version
+	assert.NoError(t, resource.TestCheckFunc(t, req, &versions, check))
+	assert.Equal(t, 1, peerCerts)
+
+	// Without the CA the server certificate isn't trusted.
+	req.Source.CaCert = ""
+	assert.Error(t, resource.TestCheckFunc(t, req, nil, check))
+
+	req.Source.InsecureSkipVerify = true
+	assert.NoError(t, resource.TestCheckFunc(t, req, &versions, check))
+}
+
+func TestCheckSourceInvalidCaCert(t *testing.T) {
+	req := testRequest{Source: Source{Url: testGerritUrl, CaCert: "not a cert"}}
+	err := resource.TestCheckFunc(t, req, nil, check)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ca_cert")
+}
+
+func TestInGitTls(t *testing.T) {
+	clientCert, clientKey := testCertificate(t)
+	files := map[string]string{}
+	var paths []string
+	for _, arg := range []string{"http.sslCAInfo", "http.sslCert", "http.sslKey"} {
+		arg := arg
+		mockGitWithArg(arg, func(args []string, idx int) {
+			path := args[idx+1]
+			paths = append(paths, path)
+			data, err := ioutil.ReadFile(path)
+			assert.NoError(t, err)
+			files[arg] = string(data)
+		})
+	}
+	var sslVerify string
+	mockGitWithArg("http.sslVerify", func(args []string, idx int) {
+		sslVerify = args[idx+1]
+	})
+
+	testIn(t, Source{
+		CaCert:             clientCert,
+		ClientCert:         clientCert,
+		ClientKey:          clientKey,
+		InsecureSkipVerify: true,
+	}, testInVersion, InParams{})
+	assert.Equal(t, clientCert, files["http.sslCAInfo"])
+	assert.Equal(t, clientCert, files["http.sslCert"])
+	assert.Equal(t, clientKey, files["http.sslKey"])
+	assert.Equal(t, "false", sslVerify)
+
+	// Temp files should be deleted
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "%s wasn't deleted", path)
+	}
+}
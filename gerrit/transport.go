@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gerritHttpClient returns the http client for Gerrit REST requests, or nil
+// if the source doesn't customize it.
+func gerritHttpClient(src Source, authMan *authManager) (*http.Client, error) {
+	tlsConfig, err := authMan.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && src.HttpProxy == "" && src.NoProxy == "" &&
+		src.RequestTimeout == "" && src.MaxIdleConns == 0 {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if src.HttpProxy != "" || src.NoProxy != "" {
+		proxy := http.ProxyFromEnvironment
+		if src.HttpProxy != "" {
+			proxyUrl, err := parseProxyUrl(src.HttpProxy)
+			if err != nil {
+				return nil, err
+			}
+			proxy = http.ProxyURL(proxyUrl)
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if noProxyMatch(src.NoProxy, req.URL) {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+	if src.MaxIdleConns > 0 {
+		// All requests go to the same host, so the per-host limit matters most.
+		transport.MaxIdleConns = src.MaxIdleConns
+		transport.MaxIdleConnsPerHost = src.MaxIdleConns
+	}
+
+	client := &http.Client{Transport: transport}
+	if src.RequestTimeout != "" {
+		client.Timeout, err = time.ParseDuration(src.RequestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request_timeout %q: %v", src.RequestTimeout, err)
+		}
+	}
+	return client, nil
+}
+
+// gitProxy returns the http.proxy git should use to fetch from fetchUrl,
+// applying the same no_proxy rules as Gerrit REST requests. ok is false if
+// git should be left to its own proxy settings; an empty proxy with ok set
+// disables any proxy from the environment.
+func gitProxy(src Source, fetchUrl string) (proxy string, ok bool, err error) {
+	if u, err := url.Parse(fetchUrl); err == nil && noProxyMatch(src.NoProxy, u) {
+		return "", true, nil
+	}
+	if src.HttpProxy == "" {
+		return "", false, nil
+	}
+	proxyUrl, err := parseProxyUrl(src.HttpProxy)
+	if err != nil {
+		return "", false, err
+	}
+	return proxyUrl.String(), true, nil
+}
+
+func parseProxyUrl(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http_proxy %q: %v", proxy, err)
+	}
+	return u, nil
+}
+
+// noProxyMatch reports whether u matches a comma-separated no_proxy list of
+// host names, domain suffixes (".example.com"), IPs, CIDRs or "*".
+func noProxyMatch(noProxy string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if ip != nil {
+			if entryIp := net.ParseIP(entry); entryIp != nil && entryIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func TestNoProxyMatch(t *testing.T) {
+	for _, test := range []struct {
+		noProxy string
+		url     string
+		match   bool
+	}{
+		{"", "https://review.example.com", false},
+		{"*", "https://review.example.com", true},
+		{"review.example.com", "https://review.example.com", true},
+		{"example.com", "https://review.example.com", true},
+		{".example.com", "https://review.example.com", true},
+		{"*.example.com", "https://review.example.com", true},
+		{"view.example.com", "https://review.example.com", false},
+		{"other.com, Example.com", "https://review.example.com/a", true},
+		{"review.example.com:8080", "https://review.example.com:8080", true},
+		{"review.example.com:8080", "https://review.example.com", false},
+		{"10.0.0.0/8", "http://10.1.2.3:8080", true},
+		{"10.0.0.0/8", "http://192.168.0.1", false},
+		{"::1", "http://[::1]:8080", true},
+	} {
+		u, err := url.Parse(test.url)
+		assert.NoError(t, err)
+		assert.Equal(t, test.match, noProxyMatch(test.noProxy, u), "%q %q", test.noProxy, test.url)
+	}
+}
+
+func testProxy(t *testing.T) (*httptest.Server, *int) {
+	proxied := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		testGerritHandler(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, &proxied
+}
+
+func TestCheckSourceHttpProxy(t *testing.T) {
+	proxy, proxied := testProxy(t)
+
+	testCheck(t, Source{HttpProxy: proxy.URL}, Version{})
+	assert.Equal(t, 1, *proxied)
+
+	testCheck(t, Source{HttpProxy: proxy.URL, NoProxy: "example.com,localhost"}, Version{})
+	assert.Equal(t, 1, *proxied)
+}
+
+func TestCheckSourceRequestTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		testGerritHandler(w, r)
+	}))
+	defer slow.Close()
+
+	req := testRequest{Source: Source{Url: slow.URL, RequestTimeout: "10ms", MaxIdleConns: 4}}
+	err := resource.TestCheckFunc(t, req, nil, check)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Client.Timeout")
+
+	req.Source.RequestTimeout = "forever"
+	err = resource.TestCheckFunc(t, req, nil, check)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "request_timeout")
+}
+
+func TestInGitHttpProxy(t *testing.T) {
+	proxy, proxied := testProxy(t)
+	var gitProxy *string
+	mockGitProxy := func() {
+		gitProxy = nil
+		mockGitWithArg("http.proxy", func(args []string, idx int) {
+			gitProxy = &args[idx+1]
+		})
+	}
+
+	mockGitProxy()
+	testIn(t, Source{HttpProxy: proxy.Listener.Addr().String()}, testInVersion, InParams{})
+	if assert.NotNil(t, gitProxy) {
+		assert.Equal(t, proxy.URL, *gitProxy)
+	}
+	assert.NotZero(t, *proxied)
+
+	mockGitProxy()
+	testIn(t, Source{HttpProxy: proxy.URL, NoProxy: "localhost"}, testInVersion, InParams{})
+	if assert.NotNil(t, gitProxy) {
+		assert.Equal(t, "", *gitProxy)
+	}
+
+	// no_proxy alone still overrides a proxy from the environment.
+	mockGitProxy()
+	testIn(t, Source{NoProxy: "localhost"}, testInVersion, InParams{})
+	if assert.NotNil(t, gitProxy) {
+		assert.Equal(t, "", *gitProxy)
+	}
+
+	mockGitProxy()
+	testIn(t, Source{}, testInVersion, InParams{})
+	assert.Nil(t, gitProxy)
+}
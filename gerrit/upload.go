@@ -0,0 +1,209 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+// upload pushes the HEAD of params.Repository to refs/for/<branch>, setting
+// the response version to the uploaded revision.
+func upload(req resource.OutRequest, src Source, authMan *authManager, params outParams) error {
+	if params.Repository == "" {
+		return errors.New("param repository required")
+	}
+	if params.Project == "" || params.Branch == "" {
+		return errors.New("upload requires params project and branch")
+	}
+	dir := filepath.Join(req.TargetDir(), params.Repository)
+
+	changeId, err := ensureChangeId(dir)
+	if err != nil {
+		return err
+	}
+	head, err := gitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	revision := strings.TrimSpace(string(head))
+
+	pushUrl := src.FetchUrl
+	if pushUrl == "" {
+		pushUrl = strings.TrimSuffix(src.Url, "/") + "/" + params.Project
+	}
+	err = authMan.verifyHostKeys(pushUrl)
+	if err != nil {
+		return err
+	}
+	configArgs, err := authMan.gitConfigArgs()
+	if err != nil {
+		return fmt.Errorf("error getting git config args: %v", err)
+	}
+	proxy, ok, err := gitProxy(src, pushUrl)
+	if err != nil {
+		return err
+	}
+	if ok {
+		configArgs["http.proxy"] = proxy
+	}
+
+	args := gitConfigFlags(configArgs)
+	args = append(args, "push")
+	for _, option := range pushOptions(params) {
+		args = append(args, "-o", option)
+	}
+	args = append(args, pushUrl, "HEAD:refs/for/"+params.Branch)
+	log.Printf("Uploading %v to %v", revision, params.Branch)
+	err = git(dir, args...)
+	if err != nil {
+		return fmt.Errorf("error uploading: %v", err)
+	}
+
+	c, err := gerritApiClient(src, authMan)
+	if err != nil {
+		return fmt.Errorf("error setting up gerrit client: %v", err)
+	}
+	triplet := fmt.Sprintf("%s~%s~%s",
+		url.PathEscape(params.Project), url.PathEscape(params.Branch), changeId)
+	change, err := c.GetChange(context.Background(), triplet,
+		gerrit.QueryChangesOpt{Fields: []string{"ALL_REVISIONS"}})
+	if err != nil {
+		return fmt.Errorf("error getting uploaded change %q: %v", triplet, err)
+	}
+	rev, ok := change.Revisions[revision]
+	if !ok {
+		return fmt.Errorf("no revision %q on uploaded change %q", revision, triplet)
+	}
+	req.SetResponseVersion(Version{
+		ChangeId: change.ID,
+		Revision: revision,
+		Created:  rev.Created.Time(),
+	})
+
+	req.AddResponseMetadata("change id", changeId)
+	link, err := buildRevisionLink(src, change.ChangeNumber, rev.PatchSetNumber)
+	if err == nil {
+		req.AddResponseMetadata("revision link", link)
+	} else {
+		log.Printf("error building revision link: %v", err)
+	}
+	return nil
+}
+
+// ensureChangeId returns the Change-Id footer of HEAD, amending HEAD to add
+// one if it has none.
+func ensureChangeId(dir string) (string, error) {
+	output, err := gitOutput(dir, "log", "-1", "--format=%B", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	message := strings.TrimSpace(string(output))
+	footers := parseFooters(message)
+	for _, footer := range footers {
+		if strings.EqualFold(footer.Key, "Change-Id") {
+			return footer.Value, nil
+		}
+	}
+
+	// Like the commit-msg hook, derive the Change-Id from the commit.
+	commit, err := gitOutput(dir, "cat-file", "commit", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	changeId := fmt.Sprintf("I%x", sha1.Sum(commit))
+	if len(footers) > 0 {
+		message += "\nChange-Id: " + changeId
+	} else {
+		message += "\n\nChange-Id: " + changeId
+	}
+	// The author is also the committer, as there may be no user configured.
+	author, err := gitOutput(dir, "log", "-1", "--format=%an%n%ae", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	name, email := splitAuthor(string(author))
+	err = git(dir, "-c", "user.name="+name, "-c", "user.email="+email,
+		"commit", "--amend", "--allow-empty", "--no-verify", "-m", message)
+	if err != nil {
+		return "", fmt.Errorf("error adding Change-Id: %v", err)
+	}
+	return changeId, nil
+}
+
+// splitAuthor splits the name and email lines of git log --format=%an%n%ae.
+func splitAuthor(output string) (name, email string) {
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	name = strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		email = strings.TrimSpace(lines[1])
+	}
+	return name, email
+}
+
+// pushOptions returns the Gerrit push options for params.
+func pushOptions(params outParams) []string {
+	var options []string
+	if params.Topic != nil && *params.Topic != "" {
+		options = append(options, "topic="+*params.Topic)
+	}
+	for _, hashtag := range params.AddHashtags {
+		options = append(options, "t="+hashtag)
+	}
+	for _, reviewer := range params.Reviewers {
+		options = append(options, "r="+reviewer)
+	}
+	for _, cc := range params.Ccs {
+		options = append(options, "cc="+cc)
+	}
+	labels := make([]string, 0, len(params.Labels))
+	for label := range params.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		options = append(options, fmt.Sprintf("l=%s%+d", label, params.Labels[label]))
+	}
+	if params.Message != "" {
+		message := params.Message
+		for k, v := range buildVariableTokens() {
+			message = strings.Replace(message, k, v, -1)
+		}
+		// Gerrit decodes the message, reading underscores as spaces.
+		options = append(options,
+			"m="+strings.Replace(url.QueryEscape(message), "_", "%5F", -1))
+	}
+	if params.Notify != "" {
+		options = append(options, "notify="+params.Notify)
+	}
+	if params.Wip {
+		options = append(options, "wip")
+	}
+	if params.Private {
+		options = append(options, "private")
+	}
+	return options
+}
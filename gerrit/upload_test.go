@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func TestUpload(t *testing.T) {
+	repoDir, err := ioutil.TempDir(testTempDir, "upload")
+	assert.NoError(t, err)
+	testGitCalls = nil
+	mockGitOutput("--format=%B", "Format code\n\nChange-Id: Itestchange5\n")
+	mockGitOutput("rev-parse", testRevisionPrefix+"1\n")
+
+	topic := "formatting"
+	req := testRequest{
+		Source: Source{Url: testGerritUrl},
+		Params: outParams{
+			Repository:  filepath.Base(repoDir),
+			Upload:      true,
+			Project:     testProject,
+			Branch:      testBranch,
+			Topic:       &topic,
+			AddHashtags: []string{"bot"},
+			Reviewers:   []string{"jane@example.com"},
+			Wip:         true,
+		},
+	}
+	var resp testResourceResponse
+	assert.NoError(t, resource.TestOutFunc(t, req, &resp, testTempDir, out))
+
+	assert.Equal(t, fmt.Sprintf("%s~%s~Itestchange5", testProject, testBranch), resp.Version.ChangeId)
+	assert.Equal(t, testRevisionPrefix+"1", resp.Version.Revision)
+	assert.Contains(t, resp.Metadata, resource.MetadataField{Name: "change id", Value: "Itestchange5"})
+	assert.Contains(t, resp.Metadata, resource.MetadataField{
+		Name: "revision link", Value: fmt.Sprintf("%s/c/5/2", testGerritUrl)})
+
+	calls := testGitCallsIn(repoDir)
+	if assert.Len(t, calls, 3) {
+		assert.Equal(t, fmt.Sprintf(
+			"push -o topic=formatting -o t=bot -o r=jane@example.com -o wip %s/%s HEAD:refs/for/%s",
+			testGerritUrl, testProject, testBranch), calls[2])
+	}
+}
+
+func TestUploadRequiresBranch(t *testing.T) {
+	req := testRequest{
+		Source: Source{Url: testGerritUrl},
+		Params: outParams{Repository: "repo", Upload: true, Project: testProject},
+	}
+	err := resource.TestOutFunc(t, req, nil, testTempDir, out)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "upload requires params project and branch")
+	}
+}
+
+func TestEnsureChangeId(t *testing.T) {
+	testGitCalls = nil
+	mockGitOutput("--format=%B", "Subject\n\nChange-Id: Iabc\n")
+	changeId, err := ensureChangeId("repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "Iabc", changeId)
+	assert.Len(t, testGitCallsIn("repo"), 1)
+
+	// Footer keys aren't case-sensitive.
+	testGitCalls = nil
+	mockGitOutput("--format=%B", "Subject\n\nChange-id: Idef\n")
+	changeId, err = ensureChangeId("repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "Idef", changeId)
+	assert.Len(t, testGitCallsIn("repo"), 1)
+}
+
+func TestEnsureChangeIdAdded(t *testing.T) {
+	for message, footers := range map[string]string{
+		"Subject\n":                      "Subject\n\nChange-Id: ",
+		"Subject\n\nBug: 123\n":          "Subject\n\nBug: 123\nChange-Id: ",
+		"Subject\n\nBody text.\nMore.\n": "Subject\n\nBody text.\nMore.\n\nChange-Id: ",
+	} {
+		testGitCalls = nil
+		mockGitOutput("--format=%B", message)
+		mockGitOutput("cat-file", "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n\n"+message)
+		mockGitOutput("--format=%an%n%ae", "Jane Doe\njane@example.com\n")
+		changeId, err := ensureChangeId("repo")
+		assert.NoError(t, err)
+		assert.Regexp(t, "^I[0-9a-f]{40}$", changeId)
+
+		calls := testGitCallsIn("repo")
+		if assert.Len(t, calls, 4) {
+			assert.Equal(t, "-c user.name=Jane Doe -c user.email=jane@example.com "+
+				"commit --amend --allow-empty --no-verify -m "+footers+changeId, calls[3])
+		}
+	}
+}
+
+func TestPushOptions(t *testing.T) {
+	assert.Empty(t, pushOptions(outParams{}))
+
+	options := pushOptions(outParams{
+		Labels:  map[string]int{"Verified": 1, "Code-Review": -2},
+		Message: "Formatted by snake_case bot",
+		Ccs:     []string{"team"},
+		Notify:  "NONE",
+		Private: true,
+	})
+	assert.Equal(t, []string{
+		"cc=team",
+		"l=Code-Review-2",
+		"l=Verified+1",
+		"m=Formatted+by+snake%5Fcase+bot",
+		"notify=NONE",
+		"private",
+	}, options)
+}
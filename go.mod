@@ -2,11 +2,16 @@ module github.com/google/concourse-resources
 
 go 1.24.5
 
+require (
+	github.com/stretchr/testify v1.10.0
+	golang.org/x/build v0.0.0-20250818204514-5308f14ab8b6
+	golang.org/x/crypto v0.45.0
+	golang.org/x/oauth2 v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
-	golang.org/x/build v0.0.0-20250818204514-5308f14ab8b6 // indirect
-	golang.org/x/oauth2 v0.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
@@ -34,7 +34,6 @@ build: $(wildcard *.go)
 	ln -sf ${NAME} build/check
 	ln -sf ${NAME} build/in
 	ln -sf ${NAME} build/out
-	[ -x askpass.sh ] && cp askpass.sh build/askpass.sh
 	echo ${BUILD} > build/.version
 
 .PHONY: clean